@@ -1,81 +1,321 @@
 // Package agent implements a mechanism to manage a single piece of
 // state. It operates asynchronously to the rest of the program. It does
-// not use a blocking goroutine for this, instead it spins up a new
-// goroutine as needed and terminates the routine when its queue of work
-// is empty. Accessing the value of an agent does not require
-// coordination with other accessors or with updaters.
+// not use a dedicated goroutine for this, instead actions are run on
+// shared pools of goroutines, a bounded pool for actions dispatched with
+// Send and a growable pool for actions dispatched with SendOff, only
+// while the agent has work queued. Accessing the value of an agent does
+// not require coordination with other accessors or with updaters.
+//
+// Unlike Clojure's agents, sends made while an action runs are not held
+// until the action completes just because they are made from within
+// it, Go gives no way of telling which action a goroutine is running.
+// An action that needs its sends held, so that they are dispatched
+// only if it succeeds, takes a Dispatcher and sends through it, see
+// Dispatcher. Sends made directly with Send or SendOff from within an
+// action are dispatched straight away, even if the action then fails.
 package agent
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
 	"jsouthworth.net/go/etm/atom"
+	"jsouthworth.net/go/etm/executor"
 	"jsouthworth.net/go/etm/internal/genfn"
-	"jsouthworth.net/go/etm/internal/jobq"
+	"jsouthworth.net/go/etm/internal/meta"
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+var (
+	// sendExecutor runs actions dispatched with Send. It is sized for
+	// CPU bound work.
+	sendExecutor = executor.NewBounded(runtime.GOMAXPROCS(0) + 2)
+	// sendOffExecutor runs actions dispatched with SendOff. It grows
+	// as needed so that blocked actions don't starve other agents.
+	sendOffExecutor = executor.NewCached(time.Minute)
 )
 
-// Agent is a mechanism to manage a single piece of state.
+// ErrNotFailed is returned by Restart when the agent is not in a
+// failed state.
+var ErrNotFailed = errors.New("agent: agent does not need a restart")
+
+// Agent is a mechanism to manage a single piece of state. An Agent is
+// the untyped view of an Of, the value is an interface{} and actions
+// and watchers may be functions of any suitable type.
 type Agent struct {
-	state *atom.Atom
-	queue *jobq.Queue
+	of   untyped
+	meta meta.Meta
+}
 
-	opts agentOptions
+// untyped is implemented by every Of. It lets Agent work with an agent
+// of any type.
+type untyped interface {
+	core() *base
+	atom() *atom.Atom
+	sendAny(ctx context.Context, exec executor.Executor, fn interface{}, args []interface{}) error
+	holdAny(exec executor.Executor, fn interface{}, args []interface{}) heldSend
 }
 
-// New returns a new agent with an initial value of s.
+// New returns a new agent with an initial value of s. New panics if a
+// Validator is supplied that rejects s.
 func New(s interface{}, options ...Option) *Agent {
-	var opts agentOptions
-	for _, option := range options {
-		option(&opts)
-	}
-
-	var atomOptions []atom.Option
-	if opts.equalityFn != nil {
-		atomOptions = append(atomOptions,
-			atom.EqualityFunc(opts.equalityFn))
-	}
-
-	return &Agent{
-		state: atom.New(s, atomOptions...),
-		queue: jobq.New(runAction),
-		opts:  opts,
-	}
+	return NewOf[interface{}](s, options...).Agent()
 }
 
 // Send dispatches an action. It returns immediately and the value
-// managed by the agent will be updated asynchronusly. Send takes a
-// function of the type func(old aT, args...) rT where aT is the old
-// type of the agent and rT is the desired type of the atom.
+// managed by the agent will be updated asynchronusly. Actions sent with
+// Send run on a pool of goroutines sized to the number of processors
+// and must not block, use SendOff for actions that may block. Actions
+// sent to an agent with Send and SendOff are run one at a time in the
+// order they were sent. Send takes a function of the type
+// func(old aT, args...) rT where aT is the old type of the agent and rT
+// is the desired type of the atom. The function may also be of the form
+// func(old aT, args...) (rT, error).
+//
+// If the action returns an error, panics, or its result is rejected by
+// the agent's validator, the agent's value is unchanged and the failure
+// is handled according to the agent's ErrorMode. Actions sent to a
+// failed agent are held until the agent is restarted.
+//
+// An action of the form func(old aT, d *Dispatcher, args...) rT is
+// passed a Dispatcher. Sends it makes through d, to this or any other
+// agent, are held until the action completes. They are dispatched if
+// the action succeeds and dropped if it fails.
+//
+// Send panics with ErrShutdown if the agent has been shut down, see
+// Dispatch for an alternative that returns the error. If the agent's
+// mailbox is full Send blocks, panics with ErrMailboxFull or drops an
+// action according to the agent's Overflow policy, see TrySend and
+// SendContext for alternatives that don't block or panic.
 //
 // Passing a func(...interface{})interface{} avoids reflect based
 // function application allow faster execution at the expense of
 // some clarity.
 func (a *Agent) Send(fn interface{}, args ...interface{}) *Agent {
-	f := genfn.MakeGeneric(fn)
-	action := &agentRequest{state: a.state, fn: f, args: args}
-	a.queue.Enqueue(action)
+	b := a.of.core()
+	b.check(a.of.sendAny(context.Background(), b.opts.sendExec, fn, args))
+	return a
+}
+
+// SendOff dispatches an action that may block, for instance on I/O. It
+// follows the same rules as Send but the action runs on a pool of
+// goroutines that grows as needed. Agents created with WithExecutor run
+// actions dispatched by Send and SendOff on the same executor.
+func (a *Agent) SendOff(fn interface{}, args ...interface{}) *Agent {
+	b := a.of.core()
+	b.check(a.of.sendAny(context.Background(), b.opts.sendOffExec, fn, args))
 	return a
 }
 
+// Dispatch is like Send but returns an error instead of panicking. It
+// returns ErrShutdown if the agent has been shut down and
+// ErrMailboxFull if the action was rejected or dropped by the agent's
+// Overflow policy.
+func (a *Agent) Dispatch(fn interface{}, args ...interface{}) error {
+	return a.of.sendAny(context.Background(), a.of.core().opts.sendExec, fn, args)
+}
+
+// DispatchOff is like SendOff but returns an error instead of
+// panicking, see Dispatch.
+func (a *Agent) DispatchOff(fn interface{}, args ...interface{}) error {
+	return a.of.sendAny(context.Background(), a.of.core().opts.sendOffExec, fn, args)
+}
+
+// check panics with the error of Send or SendOff, unless the action was
+// dropped by the DropNewest policy.
+func (a *base) check(err error) {
+	if err == nil || err == ErrMailboxFull && a.opts.overflow == DropNewest {
+		return
+	}
+	panic(err)
+}
+
 // Deref returns the current value of the agent.
 func (a *Agent) Deref() interface{} {
-	return a.state.Deref()
+	return a.of.atom().Deref()
 }
 
-func runAction(val interface{}) {
-	action := val.(*agentRequest)
-	action.state.Swap(action.fn, action.args...)
+// Await blocks until all actions sent so far, from the calling
+// goroutine, to each of the agents have been run or until ctx is
+// done. Await returns the error of the first failed agent if any of the
+// agents has failed. If an agent fails while it is being awaited Await
+// blocks until the agent is restarted or ctx is done.
+func Await(ctx context.Context, agents ...*Agent) error {
+	for _, a := range agents {
+		if err := a.Error(); err != nil {
+			return err
+		}
+	}
+	dones := make([]chan struct{}, len(agents))
+	for i, a := range agents {
+		dones[i] = make(chan struct{})
+		a.of.core().enqueue(&awaitRequest{done: dones[i]})
+	}
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
-type agentRequest struct {
-	state *atom.Atom
-	fn    func(...interface{}) interface{}
-	args  []interface{}
+// AwaitFor is like Await but gives up after timeout, returning
+// context.DeadlineExceeded.
+func AwaitFor(timeout time.Duration, agents ...*Agent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Await(ctx, agents...)
+}
+
+// Error returns the error that caused the agent to fail or nil if the
+// agent has not failed.
+func (a *Agent) Error() error {
+	return a.of.core().failure()
+}
+
+func (a *base) failure() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Restart clears the error of a failed agent and resets its value to
+// newState. If clearActions is true any actions held while the agent
+// was failed are discarded, otherwise they are run in the order they
+// were sent before any action sent after the restart. Restart returns
+// ErrNotFailed if the agent has not failed, or is being restarted by
+// another call, and ErrShutdown if it has been shut down. If the
+// validator rejects newState the agent remains failed and the
+// validation error is returned. Sync watchers are called with the
+// change to newState before Restart returns.
+func (a *Agent) Restart(newState interface{}, clearActions bool) error {
+	return a.of.core().restart(func() error {
+		_, err := a.of.atom().TryReset(newState)
+		return err
+	}, clearActions)
+}
+
+// restart restarts the agent, calling reset to reset its value.
+func (a *base) restart(reset func() error, clearActions bool) error {
+	a.mu.Lock()
+	if a.closed() {
+		a.mu.Unlock()
+		return ErrShutdown
+	}
+	if a.err == nil || a.restarting {
+		a.mu.Unlock()
+		return ErrNotFailed
+	}
+	a.restarting = true
+	a.mu.Unlock()
+
+	// Resetting the value runs the sync watchers, which may call back
+	// into the agent, so it is done without holding the lock. Actions
+	// are held until the restart is queued so nothing else changes the
+	// value meanwhile.
+	err := recoverError(reset)
+	a.mu.Lock()
+	a.restarting = false
+	if err == nil {
+		a.err = nil
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The restart may be processed on this goroutine, by a synchronous
+	// executor, so it must be queued without holding the lock.
+	a.enqueue(&restartRequest{clearActions: clearActions})
+	return nil
+}
+
+// SetValidator sets the function used to validate every new value of
+// the agent. It follows the same rules as atom.Atom.SetValidator.
+func (a *Agent) SetValidator(fn func(interface{}) error) error {
+	return a.of.atom().SetValidator(fn)
+}
+
+// Meta returns the metadata of the agent.
+func (a *Agent) Meta() interface{} {
+	return a.meta.Load()
+}
+
+// ResetMeta replaces the metadata of the agent with m.
+func (a *Agent) ResetMeta(m interface{}) interface{} {
+	return a.meta.Reset(m)
+}
+
+// AlterMeta updates the metadata of the agent synchronously to the
+// result of applying fn to the current metadata. AlterMeta takes a
+// function of the form func(old mT, args...) rT. Changing the metadata
+// does not notify the watchers.
+func (a *Agent) AlterMeta(fn interface{}, args ...interface{}) interface{} {
+	return a.meta.Alter(genfn.MakeGeneric(fn), args)
+}
+
+func (a *base) hold(req interface{}) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.failed {
+		return false
+	}
+	a.held = append(a.held, req)
+	return true
+}
+
+func (a *base) fail(err error) {
+	if a.opts.errorMode == Fail {
+		a.mu.Lock()
+		a.err = err
+		a.failed = true
+		a.mu.Unlock()
+	}
+	if a.opts.errorHandler != nil {
+		a.opts.errorHandler(a.agent, err)
+	}
+}
+
+type awaitRequest struct {
+	done chan struct{}
+}
+
+type restartRequest struct {
+	clearActions bool
+}
+
+// recoverError calls fn, returning the error of a panic as well as the
+// error fn returns.
+func recoverError(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+	}()
+	return fn()
+}
+
+func panicError(v interface{}) error {
+	if err, ok := v.(error); ok {
+		if errors.Is(err, atom.ErrInvalidState) {
+			return err
+		}
+		return fmt.Errorf("agent: action panicked: %w", err)
+	}
+	return fmt.Errorf("agent: action panicked: %v", v)
 }
 
 // Watch adds function to be called when the value of the atom changes.
 //
 // Watchers must be functions of the following form:
 // func(key kT, atom *Atom, old oT, new nT)
-// Watchers may return a value or not but any returned value is ignored.
+// Watchers may return an error, alone or after a value, which is passed
+// to the WatcherErrorHandler along with the error of a watcher that
+// panics. Any other returned value is ignored.
 // The key type must be the type of the key passed in when the watcher
 // is added, the Value types must be the type of the atom. If the atom
 // can take arbitrary types then the watcher should take type interface{}.
@@ -85,28 +325,74 @@ type agentRequest struct {
 //
 // All watchers are called asynchronously when the atom changes, this means
 // that one should not deref the atom in the watcher but should used the
-// passed in old and new values. Dispatches to the watchers are queued so
-// the set of watchers for a given update are called then the set for the
-// next and so on.
+// passed in old and new values. Each watcher has its own queue of
+// changes so it sees the changes in the order they were made, and a
+// slow watcher doesn't hold up the others. See WatcherBuffer to limit
+// the changes queued for a watcher.
 //
 // Passing a func(...interface{})interface{} avoids reflect based
 // function application allow faster execution at the expense of
 // some clarity.
 func (a *Agent) Watch(key interface{}, fn interface{}, args ...interface{}) *Agent {
-	f := genfn.MakeGeneric(fn)
-	a.state.Watch(key, &agentWatcher{fn: f, agent: a}, args...)
+	f := watchers.Fn(fn)
+	a.of.atom().Watch(key, &agentWatcher{fn: f, agent: a}, args...)
+	return a
+}
+
+// WatchSync adds a function to be called when the value of the agent
+// changes like Watch, but the function is called synchronously by
+// whatever changed the agent: by an action before the action completes
+// or by Restart before it returns. It follows the same rules as
+// atom.Atom.WatchSync, its failures never fail the action or the
+// restart. The function may call the agent's methods.
+func (a *Agent) WatchSync(key interface{}, fn interface{}, args ...interface{}) *Agent {
+	f := watchers.Fn(fn)
+	a.of.atom().WatchSync(key, &agentWatcher{fn: f, agent: a}, args...)
 	return a
 }
 
+// WatchSelect adds a function to be called when the part of the
+// agent's value picked out by selector changes. It follows the same
+// rules as atom.Atom.WatchSelect.
+func (a *Agent) WatchSelect(key interface{}, selector interface{}, fn interface{}, args ...interface{}) *Agent {
+	f := watchers.Fn(fn)
+	a.of.atom().WatchSelect(key, selector, &agentWatcher{fn: f, agent: a}, args...)
+	return a
+}
+
+// WatchPath is like WatchSelect but selects the part of the value found
+// by following path. It follows the same rules as atom.Atom.WatchPath.
+func (a *Agent) WatchPath(key interface{}, path []interface{}, fn interface{}, args ...interface{}) *Agent {
+	return a.WatchSelect(key, atom.PathSelector(path...), fn, args...)
+}
+
+// Subscribe returns a channel on which the changes to the agent are
+// sent until ctx is done. It follows the same rules as
+// atom.Atom.Subscribe.
+func (a *Agent) Subscribe(ctx context.Context, options ...atom.SubscribeOption) <-chan atom.Change {
+	return a.of.atom().Subscribe(ctx, options...)
+}
+
 // Ignore removes the watcher with the passed in key so that on the
 // next update it will not be in the watcher set. This takes effect
 // immediately so if a watcher removes its self, the next update to the
 // atom will not contain the watcher.
 func (a *Agent) Ignore(key interface{}) *Agent {
-	a.state.Ignore(key)
+	a.of.atom().Ignore(key)
 	return a
 }
 
+// AddWatch is like Watch but doesn't return the agent, see etm.Watchable.
+func (a *Agent) AddWatch(key interface{}, fn interface{}, args ...interface{}) {
+	a.Watch(key, fn, args...)
+}
+
+// RemoveWatch is like Ignore but doesn't return the agent, see
+// etm.Watchable.
+func (a *Agent) RemoveWatch(key interface{}) {
+	a.Ignore(key)
+}
+
 type agentWatcher struct {
 	fn    func(...interface{}) interface{}
 	agent *Agent
@@ -120,7 +406,25 @@ func (w *agentWatcher) Apply(args ...interface{}) interface{} {
 type Option func(*agentOptions)
 
 type agentOptions struct {
-	equalityFn func(interface{}, interface{}) bool
+	equalityFn   func(interface{}, interface{}) bool
+	validator    func(interface{}) error
+	errorMode    Mode
+	errorHandler func(*Agent, error)
+	// exec is the executor of the agent's queue, sendExec and
+	// sendOffExec route actions to another executor, nil runs them
+	// on exec.
+	exec         executor.Executor
+	sendExec     executor.Executor
+	sendOffExec  executor.Executor
+	watcherExec  executor.Executor
+	shutdownMode ShutdownMode
+	mailboxSize  int
+	overflow     Overflow
+
+	watcherBuffer   int
+	watcherOverflow atom.Overflow
+	watcherErrorFn  func(key interface{}, a *Agent, err error)
+	watcherMaxFails int
 }
 
 func EqualityFunc(fn func(a, b interface{}) bool) Option {
@@ -128,3 +432,120 @@ func EqualityFunc(fn func(a, b interface{}) bool) Option {
 		opts.equalityFn = fn
 	}
 }
+
+// Mode determines how an agent reacts to a failed action.
+type Mode int
+
+const (
+	// Fail puts the agent into a failed state when an action fails.
+	// A failed agent holds all further actions until it is restarted.
+	Fail Mode = iota + 1
+	// Continue ignores the failure and carries on with the next action.
+	Continue
+)
+
+// ErrorMode sets how the agent reacts to a failed action. The default
+// is Fail unless an ErrorHandler is supplied in which case it is
+// Continue.
+func ErrorMode(mode Mode) Option {
+	return func(opts *agentOptions) {
+		opts.errorMode = mode
+	}
+}
+
+// ErrorHandler sets a function to be called with the agent and the
+// error whenever an action fails. The handler is called on the
+// goroutine running the agent's actions, in both error modes.
+func ErrorHandler(fn func(*Agent, error)) Option {
+	return func(opts *agentOptions) {
+		opts.errorHandler = fn
+	}
+}
+
+// Validator sets the function used to validate every new value of the
+// agent. A value rejected by the validator fails the action that
+// produced it.
+func Validator(fn func(interface{}) error) Option {
+	return func(opts *agentOptions) {
+		opts.validator = fn
+	}
+}
+
+// WithExecutor sets the executor the agent's actions are run on,
+// whether they are dispatched by Send or SendOff. Actions are still run
+// one at a time in the order they were sent. Actions that block tie up
+// the executor's goroutine so they should not be run on a small bounded
+// executor shared with other agents.
+func WithExecutor(exec executor.Executor) Option {
+	return func(opts *agentOptions) {
+		opts.exec = exec
+		opts.sendExec = nil
+		opts.sendOffExec = nil
+	}
+}
+
+// WatcherExecutor sets the executor the agent's watchers are run on.
+// See atom.WatcherExecutor.
+func WatcherExecutor(exec executor.Executor) Option {
+	return func(opts *agentOptions) {
+		opts.watcherExec = exec
+	}
+}
+
+// OnShutdown sets what happens to the actions queued when the agent is
+// shut down, see ShutdownMode. The default is Drain.
+func OnShutdown(mode ShutdownMode) Option {
+	return func(opts *agentOptions) {
+		opts.shutdownMode = mode
+	}
+}
+
+// MailboxSize limits the number of actions queued for the agent to n,
+// not counting the action being run. Actions held by a failed agent are
+// counted until they are run or discarded. What happens to actions sent
+// to a full mailbox is set by MailboxOverflow. The default, 0, is an
+// unbounded mailbox. Actions sent through a Dispatcher are never
+// blocked, when the policy is Block they are queued beyond the
+// mailbox's size. An action must not Send directly to its own agent
+// when the policy is Block as it may wait for itself.
+func MailboxSize(n int) Option {
+	return func(opts *agentOptions) {
+		opts.mailboxSize = n
+	}
+}
+
+// MailboxOverflow sets what happens to actions sent to an agent whose
+// mailbox is full, see Overflow. The default is Block. With the Reject
+// policy Send and SendOff panic with ErrMailboxFull, use Dispatch,
+// TrySend or SendContext to get the error instead.
+func MailboxOverflow(policy Overflow) Option {
+	return func(opts *agentOptions) {
+		opts.overflow = policy
+	}
+}
+
+// WatcherBuffer limits the number of changes waiting to be delivered to
+// each of the agent's watchers. See atom.WatcherBuffer.
+func WatcherBuffer(n int, policy atom.Overflow) Option {
+	return func(opts *agentOptions) {
+		opts.watcherBuffer = n
+		opts.watcherOverflow = policy
+	}
+}
+
+// WatcherErrorHandler sets a function to be called when one of the
+// agent's watchers returns an error or panics. See
+// atom.WatcherErrorHandler.
+func WatcherErrorHandler(fn func(key interface{}, a *Agent, err error)) Option {
+	return func(opts *agentOptions) {
+		opts.watcherErrorFn = fn
+	}
+}
+
+// MaxWatcherFailures removes a watcher once it has failed n times in a
+// row. See atom.MaxWatcherFailures.
+func MaxWatcherFailures(n int) Option {
+	return func(opts *agentOptions) {
+		opts.watcherMaxFails = n
+	}
+}
@@ -1,10 +1,18 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"jsouthworth.net/go/etm"
+	"jsouthworth.net/go/etm/atom"
+	"jsouthworth.net/go/etm/executor"
 	"jsouthworth.net/go/immutable/hashmap"
 	"jsouthworth.net/go/seq"
 )
@@ -229,3 +237,988 @@ func TestWatch(t *testing.T) {
 		t.Fatal("ignore failed")
 	}
 }
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for agent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestErrorModeFail(t *testing.T) {
+	agt := New(0)
+	agt.Send(func(cur int) int {
+		panic("boom")
+	})
+	agt.Send(func(cur int) int {
+		return cur + 1
+	})
+	waitFor(t, func() bool { return agt.Error() != nil })
+	if got := agt.Deref(); got != 0 {
+		t.Fatalf("got %v, wanted %v\n", got, 0)
+	}
+
+	if err := agt.Restart(10, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := agt.Error(); err != nil {
+		t.Fatal("restart didn't clear error:", err)
+	}
+	agt.Send(func(cur int) int {
+		return cur * 2
+	})
+	waitFor(t, func() bool { return agt.Deref() == 22 })
+}
+
+func TestRestartClearActions(t *testing.T) {
+	agt := New(0)
+	agt.Send(func(cur int) int {
+		panic(errors.New("boom"))
+	})
+	waitFor(t, func() bool { return agt.Error() != nil })
+	agt.Send(func(cur int) int {
+		return cur + 1
+	})
+	if err := agt.Restart(10, true); err != nil {
+		t.Fatal(err)
+	}
+	agt.Send(func(cur int) int {
+		return cur * 2
+	})
+	waitFor(t, func() bool { return agt.Deref() == 20 })
+	if err := agt.Restart(0, true); err != ErrNotFailed {
+		t.Fatalf("got %v, wanted %v\n", err, ErrNotFailed)
+	}
+}
+
+func TestRestartSynchronous(t *testing.T) {
+	agt := New(0, WithExecutor(executor.Synchronous))
+	agt.Send(func(cur int) int {
+		panic(errors.New("boom"))
+	})
+	if agt.Error() == nil {
+		t.Fatal("agent didn't fail")
+	}
+	agt.Send(func(cur int) int {
+		return cur + 1
+	})
+	if err := agt.Restart(10, false); err != nil {
+		t.Fatal(err)
+	}
+	// The held action has run by the time Restart returns.
+	if got := agt.Deref(); got != 11 {
+		t.Fatalf("got %v, wanted %v\n", got, 11)
+	}
+	agt.Send(func(cur int) int {
+		return cur * 2
+	})
+	if got := agt.Deref(); got != 22 {
+		t.Fatalf("got %v, wanted %v\n", got, 22)
+	}
+}
+
+func TestRestartWatchSync(t *testing.T) {
+	errs := make(chan error, 1)
+	agt := New(0)
+	agt.WatchSync("foo", func(key string, a *Agent, old, new int) {
+		errs <- a.Error()
+		if err := a.Restart(new, false); err != ErrNotFailed {
+			t.Errorf("got %v, wanted %v\n", err, ErrNotFailed)
+		}
+	})
+	boom := errors.New("boom")
+	agt.Send(func(cur int) (int, error) {
+		return cur, boom
+	})
+	waitFor(t, func() bool { return agt.Error() != nil })
+	if err := agt.Restart(10, false); err != nil {
+		t.Fatal(err)
+	}
+	// The watcher ran during the restart, before the error was
+	// cleared.
+	if err := <-errs; err != boom {
+		t.Fatalf("got %v, wanted %v\n", err, boom)
+	}
+	if err := agt.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	agt := New(0, ErrorHandler(func(a *Agent, err error) {
+		errs <- err
+	}))
+	boom := errors.New("boom")
+	agt.Send(func(cur int) int {
+		panic(boom)
+	})
+	agt.Send(func(cur int) int {
+		return cur + 1
+	})
+	if err := <-errs; !errors.Is(err, boom) {
+		t.Fatalf("got %v, wanted %v\n", err, boom)
+	}
+	waitFor(t, func() bool { return agt.Deref() == 1 })
+	if err := agt.Error(); err != nil {
+		t.Fatal("continue mode agent failed:", err)
+	}
+}
+
+func TestAwait(t *testing.T) {
+	a := New(0)
+	b := New(0)
+	for i := 0; i < 100; i++ {
+		a.Send(func(cur, next int) int {
+			return cur + next
+		}, i)
+		b.Send(func(cur int) int {
+			return cur + 1
+		})
+	}
+	if err := Await(context.Background(), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Deref(); got != 4950 {
+		t.Fatalf("got %v, wanted %v\n", got, 4950)
+	}
+	if got := b.Deref(); got != 100 {
+		t.Fatalf("got %v, wanted %v\n", got, 100)
+	}
+}
+
+func TestAwaitFor(t *testing.T) {
+	a := New(0)
+	release := make(chan struct{})
+	a.Send(func(cur int) int {
+		<-release
+		return cur + 1
+	})
+	if err := AwaitFor(10*time.Millisecond, a); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, wanted %v\n", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := AwaitFor(2*time.Second, a); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestAwaitFailed(t *testing.T) {
+	a := New(0)
+	a.Send(func(cur int) int {
+		panic("boom")
+	})
+	waitFor(t, func() bool { return a.Error() != nil })
+	if err := Await(context.Background(), a); err == nil {
+		t.Fatal("expected await on a failed agent to return its error")
+	}
+}
+
+func TestOf(t *testing.T) {
+	agt := NewOf(0)
+	changes := make(chan int, 100)
+	agt.Watch("foo", func(key interface{}, a *Of[int], old, new int) {
+		changes <- new
+	})
+	for i := 0; i < 100; i++ {
+		agt.Send(func(cur int) int {
+			return cur + 1
+		})
+	}
+	if err := AwaitFor(2*time.Second, agt.Agent()); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 100 {
+		t.Fatalf("got %v, wanted %v\n", got, 100)
+	}
+	for i := 1; i <= 100; i++ {
+		if got := <-changes; got != i {
+			t.Fatalf("got %v, wanted %v\n", got, i)
+		}
+	}
+	if err := agt.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := agt.Dispatch(func(cur int) int { return cur + 1 }); err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v\n", err, ErrShutdown)
+	}
+}
+
+func TestOfAgent(t *testing.T) {
+	var failed *Agent
+	agt := NewOf(0, ErrorHandler(func(a *Agent, err error) {
+		failed = a
+	}))
+	view := agt.Agent()
+	if view != agt.Agent() {
+		t.Fatal("expected the same view")
+	}
+	changes := make(chan int, 2)
+	agt.Watch("foo", func(key interface{}, a *Of[int], old, new int) {
+		changes <- new
+	})
+	agt.Send(func(cur int) int { return cur + 1 })
+	view.Send(func(cur int, n int) int { return cur + n }, 2)
+	view.Send(func(cur int) (int, error) {
+		return cur, errors.New("failed")
+	})
+	if err := AwaitFor(2*time.Second, view); err != nil {
+		t.Fatal(err)
+	}
+	if got := view.Deref(); got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	if got := agt.Deref(); got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	for _, want := range []int{1, 3} {
+		if got := <-changes; got != want {
+			t.Fatalf("got %v, wanted %v\n", got, want)
+		}
+	}
+	if failed != view {
+		t.Fatal("expected the error handler to be passed the view")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	agt := New(0, Validator(func(v interface{}) error {
+		if v.(int) < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}))
+	agt.Send(func(cur int) int {
+		return cur - 1
+	})
+	waitFor(t, func() bool { return agt.Error() != nil })
+	if err := agt.Error(); !errors.Is(err, atom.ErrInvalidState) {
+		t.Fatalf("got %v, wanted %v\n", err, atom.ErrInvalidState)
+	}
+	if got := agt.Deref(); got != 0 {
+		t.Fatalf("got %v, wanted %v\n", got, 0)
+	}
+	if err := agt.Restart(-1, true); !errors.Is(err, atom.ErrInvalidState) {
+		t.Fatalf("got %v, wanted %v\n", err, atom.ErrInvalidState)
+	}
+	if err := agt.Restart(5, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 5 {
+		t.Fatalf("got %v, wanted %v\n", got, 5)
+	}
+}
+
+func TestActionReturningError(t *testing.T) {
+	errBoom := errors.New("boom")
+	agt := New(0)
+	agt.Send(func(cur int) (int, error) {
+		return cur + 1, nil
+	})
+	agt.Send(func(cur int) (int, error) {
+		return 0, errBoom
+	})
+	waitFor(t, func() bool { return agt.Error() != nil })
+	if err := agt.Error(); err != errBoom {
+		t.Fatalf("got %v, wanted %v\n", err, errBoom)
+	}
+	if got := agt.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+var (
+	_ etm.Deref       = (*Agent)(nil)
+	_ etm.Watchable   = (*Agent)(nil)
+	_ etm.Validatable = (*Agent)(nil)
+	_ etm.MetaHolder  = (*Agent)(nil)
+)
+
+func TestAddWatch(t *testing.T) {
+	changes := make(chan interface{}, 2)
+	refs := []etm.Watchable{New(0), atom.New(0)}
+	for _, r := range refs {
+		r.AddWatch("foo", func(key string, r etm.Watchable, old, new int) {
+			changes <- r
+		})
+	}
+	refs[0].(*Agent).Send(func(cur int) int { return cur + 1 })
+	refs[1].(*atom.Atom).Reset(1)
+	got := map[interface{}]bool{<-changes: true, <-changes: true}
+	if !got[refs[0]] || !got[refs[1]] {
+		t.Fatalf("got %v, wanted %v\n", got, refs)
+	}
+	for _, r := range refs {
+		r.RemoveWatch("foo")
+	}
+	refs[1].(*atom.Atom).Reset(2)
+	select {
+	case r := <-changes:
+		t.Fatalf("removed watcher called for %v\n", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestMeta(t *testing.T) {
+	agt := New(0)
+	agt.ResetMeta("foo")
+	agt.AlterMeta(func(cur string) string {
+		return cur + "bar"
+	})
+	if m := agt.Meta(); m != "foobar" {
+		t.Fatalf("got %v, wanted %v\n", m, "foobar")
+	}
+}
+
+func TestSendOff(t *testing.T) {
+	// Far more blocking actions than the Send pool could run at once
+	// must all be able to run concurrently.
+	const n = 200
+	var started sync.WaitGroup
+	started.Add(n)
+	release := make(chan struct{})
+	agents := make([]*Agent, n)
+	for i := range agents {
+		agents[i] = New(0).SendOff(func(cur int) int {
+			started.Done()
+			<-release
+			return cur + 1
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for blocking actions to start")
+	}
+	close(release)
+	if err := AwaitFor(2*time.Second, agents...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendBounded(t *testing.T) {
+	const n = 100
+	var running, peak int32
+	agents := make([]*Agent, n)
+	for i := range agents {
+		agents[i] = New(0).Send(func(cur int) int {
+			cur32 := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if cur32 <= old ||
+					atomic.CompareAndSwapInt32(&peak, old, cur32) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return cur + 1
+		})
+	}
+	if err := AwaitFor(5*time.Second, agents...); err != nil {
+		t.Fatal(err)
+	}
+	if max := int32(runtime.GOMAXPROCS(0) + 2); peak > max {
+		t.Fatalf("%v actions ran at once, wanted at most %v", peak, max)
+	}
+}
+
+func TestSendOrdering(t *testing.T) {
+	agt := New([]int(nil))
+	for i := 0; i < 100; i++ {
+		add := func(cur []int, i int) []int {
+			return append(cur, i)
+		}
+		if i%3 == 0 {
+			agt.SendOff(add, i)
+		} else {
+			agt.Send(add, i)
+		}
+	}
+	if err := AwaitFor(2*time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	got := agt.Deref().([]int)
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("actions ran out of order: %v", got)
+		}
+	}
+	if len(got) != 100 {
+		t.Fatalf("got %v actions, wanted %v", len(got), 100)
+	}
+}
+
+func TestWithExecutor(t *testing.T) {
+	var watched []int
+	agt := New(0,
+		WithExecutor(executor.Synchronous),
+		WatcherExecutor(executor.Synchronous))
+	agt.Watch("foo", func(key string, a *Agent, old, new int) {
+		watched = append(watched, new)
+	})
+	agt.Send(func(cur int) int {
+		return cur + 1
+	}).SendOff(func(cur int) int {
+		return cur * 10
+	})
+	// Actions and watchers have all run by the time Send returns.
+	if got := agt.Deref(); got != 10 {
+		t.Fatalf("got %v, wanted %v", got, 10)
+	}
+	if len(watched) != 2 || watched[0] != 1 || watched[1] != 10 {
+		t.Fatalf("got %v, wanted %v", watched, []int{1, 10})
+	}
+}
+
+func TestWithExecutorInstrumented(t *testing.T) {
+	var runs int32
+	exec := executor.Func(func(fn func()) {
+		atomic.AddInt32(&runs, 1)
+		executor.Default.Execute(fn)
+	})
+	agt := New(0, WithExecutor(exec))
+	agt.Send(func(cur int) int { return cur + 1 })
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&runs) == 0 {
+		t.Fatal("actions were not run on the supplied executor")
+	}
+}
+
+func TestNestedSendHeld(t *testing.T) {
+	a := New(0)
+	b := New(0)
+	release := make(chan struct{})
+	a.Send(func(cur int, d *Dispatcher, inc int) int {
+		d.Send(b, func(cur int) int {
+			return cur + inc
+		})
+		<-release
+		return cur + inc
+	}, 1)
+	time.Sleep(10 * time.Millisecond)
+	if got := b.Deref(); got != 0 {
+		t.Fatalf("nested send ran before the action completed, got %v", got)
+	}
+	close(release)
+	if err := AwaitFor(time.Second, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := AwaitFor(time.Second, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+}
+
+func TestNestedSendDropped(t *testing.T) {
+	a := New(0, ErrorMode(Continue))
+	b := New(0)
+	a.Send(func(cur int, d *Dispatcher) int {
+		d.Send(b, func(cur int) int {
+			return cur + 1
+		})
+		panic("failed")
+	})
+	a.Send(func(cur int, d *Dispatcher) (int, error) {
+		d.SendOff(b, func(cur int) int {
+			return cur + 100
+		})
+		return cur, errors.New("failed")
+	})
+	a.Send(func(cur int, d *Dispatcher) int {
+		d.Send(b, func(cur int) int {
+			return cur + 10
+		})
+		return cur
+	})
+	if err := AwaitFor(time.Second, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := AwaitFor(time.Second, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Deref(); got != 10 {
+		t.Fatalf("got %v, wanted %v", got, 10)
+	}
+}
+
+func TestOfSendWith(t *testing.T) {
+	a := NewOf(0, ErrorMode(Continue))
+	b := NewOf(0)
+	a.SendWith(func(cur int, d *Dispatcher) int {
+		d.Send(b.Agent(), func(cur int) int { return cur + 1 })
+		panic("failed")
+	})
+	a.SendOffWith(func(cur int, d *Dispatcher) int {
+		d.SendOff(b.Agent(), func(cur int) int { return cur + 10 })
+		return cur + 1
+	})
+	if err := AwaitFor(time.Second, a.Agent()); err != nil {
+		t.Fatal(err)
+	}
+	if err := AwaitFor(time.Second, b.Agent()); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+	if got := b.Deref(); got != 10 {
+		t.Fatalf("got %v, wanted %v", got, 10)
+	}
+}
+
+func TestNestedSendSelf(t *testing.T) {
+	agt := New([]int(nil), WithExecutor(executor.Synchronous),
+		MailboxSize(1), MailboxOverflow(Block))
+	agt.Send(func(cur []int, d *Dispatcher) []int {
+		// Neither send waits for room in the mailbox.
+		for i := 2; i <= 3; i++ {
+			d.Send(agt, func(cur []int, i int) []int {
+				return append(cur, i)
+			}, i)
+		}
+		return append(cur, 1)
+	})
+	if got := fmt.Sprint(agt.Deref()); got != "[1 2 3]" {
+		t.Fatalf("got %v, wanted %v", got, "[1 2 3]")
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	agt := New(0)
+	release := make(chan struct{})
+	agt.Send(func(cur int) int {
+		<-release
+		return cur + 1
+	})
+	for i := 0; i < 10; i++ {
+		agt.Send(func(cur int) int { return cur + 1 })
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := agt.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := agt.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 11 {
+		t.Fatalf("got %v, wanted %v", got, 11)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrShutdown {
+				t.Fatalf("got %v, wanted %v", r, ErrShutdown)
+			}
+		}()
+		agt.Send(func(cur int) int { return cur + 1 })
+	}()
+	if err := agt.Dispatch(func(cur int) int { return cur + 1 }); err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+	}
+	if err := agt.DispatchOff(func(cur int) int { return cur + 1 }); err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+	}
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownDiscard(t *testing.T) {
+	agt := New(0, OnShutdown(Discard))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	agt.Send(func(cur int) int {
+		close(started)
+		<-release
+		return cur + 1
+	})
+	for i := 0; i < 10; i++ {
+		agt.Send(func(cur int) int { return cur + 1 })
+	}
+	<-started
+	done := make(chan error)
+	go func() { done <- agt.Shutdown(context.Background()) }()
+	waitFor(t, agt.of.core().closed)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+}
+
+func TestShutdownFailed(t *testing.T) {
+	agt := New(0)
+	agt.Send(func(cur int) int { panic("failed") })
+	waitFor(t, func() bool { return agt.Error() != nil })
+	agt.Send(func(cur int) int { return cur + 1 })
+	if err := agt.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := agt.Restart(0, false); err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+	}
+}
+
+func TestShutdownBlockedSend(t *testing.T) {
+	agt := New(0, MailboxSize(1))
+	agt.Send(func(cur int) int { panic("failed") })
+	waitFor(t, func() bool { return agt.Error() != nil })
+	agt.Send(func(cur int) int { return cur + 1 })
+	waitFor(t, func() bool { return agt.Stats().Held == 1 })
+	done := make(chan error)
+	go func() {
+		done <- agt.Dispatch(func(cur int) int { return cur + 1 })
+	}()
+	if err := agt.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+	}
+}
+
+func TestShutdownAll(t *testing.T) {
+	a := New(0)
+	b := New(0, OnShutdown(Discard))
+	var started sync.WaitGroup
+	started.Add(2)
+	release := make(chan struct{})
+	for _, agt := range []*Agent{a, b} {
+		agt.Send(func(cur int) int {
+			started.Done()
+			<-release
+			return cur + 1
+		})
+		agt.Send(func(cur int) int { return cur + 1 })
+	}
+	started.Wait()
+	done := make(chan error)
+	go func() { done <- ShutdownAll(context.Background()) }()
+	waitFor(t, a.of.core().closed)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Deref(); got != 2 {
+		t.Fatalf("got %v, wanted %v", got, 2)
+	}
+	if got := b.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+	if err := a.Dispatch(func(cur int) int { return cur + 1 }); err != ErrShutdown {
+		t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+	}
+	// A send blocked on a full mailbox is rejected.
+	d := New(0, MailboxSize(1))
+	d.Send(func(cur int) int { panic("failed") })
+	waitFor(t, func() bool { return d.Error() != nil })
+	d.Send(func(cur int) int { return cur + 1 })
+	waitFor(t, func() bool { return d.Stats().Held == 1 })
+	go func() {
+		done <- d.Dispatch(func(cur int) int { return cur + 1 })
+	}()
+	if err := ShutdownAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrShutdown {
+			t.Fatalf("got %v, wanted %v", err, ErrShutdown)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout while waiting for the blocked send")
+	}
+	// Agents created after ShutdownAll are not shut down.
+	c := New(0).Send(func(cur int) int { return cur + 1 })
+	if err := AwaitFor(time.Second, c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+}
+
+// blocked returns an agent with a full mailbox of size n whose running
+// action waits for release to be closed.
+func blocked(t *testing.T, n int, policy Overflow) (*Agent, chan struct{}) {
+	t.Helper()
+	agt := New([]int(nil), MailboxSize(n), MailboxOverflow(policy))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	agt.Send(func(cur []int) []int {
+		close(started)
+		<-release
+		return cur
+	})
+	<-started
+	for i := 0; i < n; i++ {
+		agt.Send(func(cur []int, i int) []int {
+			return append(cur, i)
+		}, i)
+	}
+	return agt, release
+}
+
+func TestMailboxBlock(t *testing.T) {
+	agt, release := blocked(t, 2, Block)
+	sent := make(chan struct{})
+	go func() {
+		agt.Send(func(cur []int) []int { return append(cur, 2) })
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send to a full mailbox did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := agt.TrySend(func(cur []int) []int { return cur }); err != ErrMailboxFull {
+		t.Fatalf("got %v, wanted %v", err, ErrMailboxFull)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := agt.SendContext(ctx, func(cur []int) []int { return cur })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	<-sent
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(agt.Deref()); got != "[0 1 2]" {
+		t.Fatalf("got %v, wanted %v", got, "[0 1 2]")
+	}
+}
+
+func TestMailboxReject(t *testing.T) {
+	agt, release := blocked(t, 1, Reject)
+	if err := agt.TrySend(func(cur []int) []int { return cur }); err != ErrMailboxFull {
+		t.Fatalf("got %v, wanted %v", err, ErrMailboxFull)
+	}
+	if err := agt.Dispatch(func(cur []int) []int { return cur }); err != ErrMailboxFull {
+		t.Fatalf("got %v, wanted %v", err, ErrMailboxFull)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrMailboxFull {
+				t.Fatalf("got %v, wanted %v", r, ErrMailboxFull)
+			}
+		}()
+		agt.Send(func(cur []int) []int { return cur })
+	}()
+	close(release)
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if err := agt.TrySend(func(cur []int) []int { return cur }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMailboxDropNewest(t *testing.T) {
+	agt, release := blocked(t, 2, DropNewest)
+	agt.Send(func(cur []int) []int { return append(cur, 2) })
+	if err := agt.TrySend(func(cur []int) []int { return append(cur, 3) }); err != ErrMailboxFull {
+		t.Fatalf("got %v, wanted %v", err, ErrMailboxFull)
+	}
+	close(release)
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(agt.Deref()); got != "[0 1]" {
+		t.Fatalf("got %v, wanted %v", got, "[0 1]")
+	}
+}
+
+func TestMailboxDropOldest(t *testing.T) {
+	agt, release := blocked(t, 2, DropOldest)
+	agt.Send(func(cur []int) []int { return append(cur, 2) })
+	if err := agt.TrySend(func(cur []int) []int { return append(cur, 3) }); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(agt.Deref()); got != "[2 3]" {
+		t.Fatalf("got %v, wanted %v", got, "[2 3]")
+	}
+}
+
+func TestMailboxFailed(t *testing.T) {
+	agt := New(0, MailboxSize(2), MailboxOverflow(Reject))
+	agt.Send(func(cur int) int { panic("failed") })
+	waitFor(t, func() bool { return agt.Error() != nil })
+	for i := 0; i < 2; i++ {
+		agt.Send(func(cur int) int { return cur + 1 })
+	}
+	// The held actions still fill the mailbox.
+	waitFor(t, func() bool { return agt.Stats().Held == 2 })
+	if err := agt.TrySend(func(cur int) int { return cur + 1 }); err != ErrMailboxFull {
+		t.Fatalf("got %v, wanted %v", err, ErrMailboxFull)
+	}
+	if err := agt.Restart(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 2 {
+		t.Fatalf("got %v, wanted %v", got, 2)
+	}
+	if err := agt.TrySend(func(cur int) int { return cur + 1 }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMailboxFailedDropOldest(t *testing.T) {
+	agt := New(0, MailboxSize(2), MailboxOverflow(DropOldest))
+	agt.Send(func(cur int) int { panic("failed") })
+	waitFor(t, func() bool { return agt.Error() != nil })
+	agt.Send(func(cur int) int { return cur + 1 })
+	agt.Send(func(cur int) int { return cur + 10 })
+	waitFor(t, func() bool { return agt.Stats().Held == 2 })
+	// The oldest held action makes room for the new one.
+	if err := agt.TrySend(func(cur int) int { return cur + 100 }); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Stats().Held; got != 1 {
+		t.Fatalf("got %v held, wanted %v", got, 1)
+	}
+	if err := agt.Restart(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := agt.Deref(); got != 110 {
+		t.Fatalf("got %v, wanted %v", got, 110)
+	}
+}
+
+func TestStats(t *testing.T) {
+	agt := New(0, ErrorMode(Continue))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	agt.Send(func(cur int) int {
+		close(started)
+		<-release
+		time.Sleep(time.Millisecond)
+		return cur + 1
+	})
+	<-started
+	agt.Send(func(cur int) int { panic("failed") })
+	agt.Send(func(cur int) int { return cur + 1 })
+	stats := agt.Stats()
+	if !stats.Running || stats.Pending != 2 {
+		t.Fatalf("got %+v, wanted a running agent with 2 pending", stats)
+	}
+	close(release)
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !agt.Stats().Running })
+	stats = agt.Stats()
+	if stats.Pending != 0 || stats.Processed != 3 || stats.Failed != 1 {
+		t.Fatalf("got %+v, wanted 3 processed and 1 failed", stats)
+	}
+	if stats.Latency <= 0 {
+		t.Fatalf("got latency %v, wanted a positive latency", stats.Latency)
+	}
+}
+
+func TestWatchSync(t *testing.T) {
+	agt := New(0)
+	var watched int32
+	agt.WatchSync("sync", func(key string, a *Agent, old, new int) {
+		atomic.StoreInt32(&watched, int32(new))
+	})
+	agt.Send(func(cur int) int { return cur + 1 })
+	// Await returns once the action is complete which includes its
+	// synchronous watchers.
+	if err := AwaitFor(time.Second, agt); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&watched); got != 1 {
+		t.Fatalf("got %v, wanted %v", got, 1)
+	}
+}
+
+func TestWatcherErrorHandler(t *testing.T) {
+	handled := make(chan *Agent, 1)
+	agt := New(0, WatcherErrorHandler(func(key interface{}, a *Agent, err error) {
+		handled <- a
+	}))
+	agt.Watch("foo", func(key string, a *Agent, old, new int) {
+		panic("boom")
+	})
+	agt.Send(func(cur int) int { return cur + 1 })
+	select {
+	case a := <-handled:
+		if a != agt {
+			t.Fatal("handler wasn't passed the agent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler wasn't called")
+	}
+	if err := agt.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	agt := New(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := agt.Subscribe(ctx)
+	for i := 0; i < 3; i++ {
+		agt.Send(func(cur int) int { return cur + 1 })
+	}
+	for i := 1; i <= 3; i++ {
+		if c := <-changes; c.New != i {
+			t.Fatalf("got %v, wanted %v", c.New, i)
+		}
+	}
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Fatal("channel wasn't closed after cancel")
+	}
+}
+
+func TestWatchPath(t *testing.T) {
+	agt := New(hashmap.New("a", 0, "b", 0),
+		WithExecutor(executor.Synchronous),
+		WatcherExecutor(executor.Synchronous))
+	var got []interface{}
+	agt.WatchPath("foo", []interface{}{"a"},
+		func(key string, a *Agent, old, new interface{}) {
+			if a != agt {
+				t.Error("watcher wasn't passed the agent")
+			}
+			got = append(got, new)
+		})
+	agt.Send(func(m *hashmap.Map) *hashmap.Map { return m.Assoc("b", 1) })
+	agt.Send(func(m *hashmap.Map) *hashmap.Map { return m.Assoc("a", 1) })
+	if len(got) != 1 || got[0] != 1 {
+		t.Fatalf("got %v, wanted %v", got, []interface{}{1})
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"jsouthworth.net/go/etm/executor"
+)
+
+// ErrMailboxFull is returned, or panicked with by Send, when an action
+// can't be queued because the agent's mailbox is full.
+var ErrMailboxFull = errors.New("agent: mailbox is full")
+
+// errDropped reports an action dropped by the DropNewest policy.
+var errDropped = errors.New("agent: action dropped")
+
+// Overflow determines what happens to an action sent to an agent whose
+// mailbox is full.
+type Overflow int
+
+const (
+	// Block makes Send wait until there is room in the mailbox.
+	Block Overflow = iota + 1
+	// Reject makes Send panic with ErrMailboxFull, Dispatch, TrySend
+	// and SendContext return it.
+	Reject
+	// DropNewest drops the action being sent.
+	DropNewest
+	// DropOldest drops the oldest action in the mailbox to make room
+	// for the one being sent.
+	DropOldest
+)
+
+// TrySend dispatches an action like Send but never blocks. It returns
+// ErrMailboxFull if the action could not be queued, because the mailbox
+// is full and the overflow policy is Block, Reject or DropNewest, and
+// ErrShutdown if the agent has been shut down.
+func (a *Agent) TrySend(fn interface{}, args ...interface{}) error {
+	return a.of.sendAny(nil, a.of.core().opts.sendExec, fn, args)
+}
+
+// SendContext dispatches an action like Send. When the mailbox is full
+// and the overflow policy is Block it waits for room until ctx is done
+// and then returns its error. It returns ErrMailboxFull if the action
+// was rejected or dropped and ErrShutdown if the agent has been shut
+// down.
+func (a *Agent) SendContext(ctx context.Context, fn interface{}, args ...interface{}) error {
+	return a.of.sendAny(ctx, a.of.core().opts.sendExec, fn, args)
+}
+
+// mailItem is the part of an action that tracks its place in the
+// mailbox.
+type mailItem struct {
+	exec executor.Executor
+	// slot reports whether the action holds a place in the mailbox
+	// and left whether it has been taken from the queue.
+	slot bool
+	left bool
+}
+
+// Executor routes the action to the executor it was sent with.
+func (m *mailItem) Executor() executor.Executor {
+	return m.exec
+}
+
+func (m *mailItem) mail() *mailItem {
+	return m
+}
+
+// action is implemented by the actions queued for an agent.
+type action interface {
+	mail() *mailItem
+}
+
+// send queues an action. A nil ctx means the caller must not wait.
+func (a *Of[T]) send(ctx context.Context, req *request[T]) error {
+	if a.closed() {
+		return ErrShutdown
+	}
+	err := a.admit(ctx, &req.mailItem)
+	switch err {
+	case nil:
+		// The agent may have been shut down while waiting for room
+		// in the mailbox.
+		if a.closed() {
+			a.releaseSlot(&req.mailItem)
+			return ErrShutdown
+		}
+		a.enqueue(req)
+		return nil
+	case errDropped:
+		return ErrMailboxFull
+	default:
+		return err
+	}
+}
+
+// admit takes a place in the mailbox for req. A nil ctx means the
+// caller must not wait.
+func (a *base) admit(ctx context.Context, req *mailItem) error {
+	if a.slots == nil {
+		return nil
+	}
+	select {
+	case a.slots <- struct{}{}:
+		req.slot = true
+		return nil
+	default:
+	}
+	switch a.opts.overflow {
+	case Reject:
+		return ErrMailboxFull
+	case DropNewest:
+		return errDropped
+	case DropOldest:
+		req.slot = true
+		if a.evictHeld() {
+			return nil
+		}
+		// The oldest action gives its place to req when it is
+		// dropped.
+		atomic.AddInt32(&a.skip, 1)
+		return nil
+	}
+	if ctx == nil {
+		return ErrMailboxFull
+	}
+	select {
+	case a.slots <- struct{}{}:
+		req.slot = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.stopped:
+		return ErrShutdown
+	case <-a.gen.closed:
+		return ErrShutdown
+	}
+}
+
+// admitNested queues an action held by a Dispatcher. It never waits
+// since the agent may be the one running the action, so when the
+// mailbox is full and the policy is Block the action is queued beyond
+// the mailbox's size. It reports whether req may be queued, actions
+// that are rejected are dropped.
+func (a *base) admitNested(req *mailItem) bool {
+	err := a.admit(nil, req)
+	if err == ErrMailboxFull && a.opts.overflow == Block {
+		err = nil
+	}
+	return err == nil
+}
+
+// leaveMailbox is called as req is taken from the queue. It reports
+// whether req must be dropped to make room for a newer action, in which
+// case its place in the mailbox has been given to the newer action.
+func (a *base) leaveMailbox(req *mailItem) bool {
+	if a.slots == nil || req.left {
+		return false
+	}
+	req.left = true
+	for {
+		skip := atomic.LoadInt32(&a.skip)
+		if skip == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&a.skip, skip, skip-1) {
+			return true
+		}
+	}
+}
+
+// evictHeld drops the oldest action held by a failed agent that has a
+// place in the mailbox, giving its place to a newer action. Held
+// actions are older than any still queued. It reports whether an
+// action was dropped.
+func (a *base) evictHeld() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, val := range a.held {
+		if req, ok := val.(action); ok && req.mail().slot {
+			req.mail().slot = false
+			a.held = append(a.held[:i:i], a.held[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// releaseSlot frees req's place in the mailbox once it has been run or
+// dropped. An action held by a failed agent keeps its place until then.
+func (a *base) releaseSlot(req *mailItem) {
+	if !req.slot {
+		return
+	}
+	req.slot = false
+	select {
+	case <-a.slots:
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"reflect"
+
+	"jsouthworth.net/go/etm/executor"
+)
+
+// A Dispatcher holds the sends made by an action until the action
+// completes. They are dispatched if it succeeds and dropped if it
+// fails, so an action's effects on other agents are all or nothing.
+//
+// An action sent to an Agent receives a Dispatcher by taking one as its
+// argument after the agent's value, that is by being of the form
+// func(old aT, d *Dispatcher, args...) rT. Actions of the form
+// func(...interface{}) interface{} are never passed one. An action
+// sent to an Of receives one when it is sent with SendWith or
+// SendOffWith. The Dispatcher must not be used once the action has
+// returned. Sends made directly with Send or SendOff from within an
+// action are not held.
+type Dispatcher struct {
+	sends []heldSend
+}
+
+// heldSend is an action held by a Dispatcher.
+type heldSend interface {
+	dispatchHeld()
+}
+
+// Send holds an action to be sent to a with Agent.Send once the action
+// running completes successfully. Sends to agents that have been shut
+// down by then, or whose mailbox rejects them, are dropped. Sends are
+// never blocked by a full mailbox, when the Overflow policy is Block
+// the action is queued beyond the mailbox's size.
+func (d *Dispatcher) Send(a *Agent, fn interface{}, args ...interface{}) {
+	d.hold(a, a.of.core().opts.sendExec, fn, args)
+}
+
+// SendOff is like Send but the action is sent with Agent.SendOff.
+func (d *Dispatcher) SendOff(a *Agent, fn interface{}, args ...interface{}) {
+	d.hold(a, a.of.core().opts.sendOffExec, fn, args)
+}
+
+func (d *Dispatcher) hold(a *Agent, exec executor.Executor, fn interface{}, args []interface{}) {
+	d.sends = append(d.sends, a.of.holdAny(exec, fn, args))
+}
+
+// release dispatches the held sends.
+func (d *Dispatcher) release() {
+	if d == nil {
+		return
+	}
+	for _, req := range d.sends {
+		req.dispatchHeld()
+	}
+}
+
+var dispatcherType = reflect.TypeOf((*Dispatcher)(nil))
+
+// takesDispatcher reports whether fn is an action that is passed a
+// Dispatcher.
+func takesDispatcher(fn interface{}) bool {
+	t := reflect.TypeOf(fn)
+	return t != nil && t.Kind() == reflect.Func &&
+		t.NumIn() > 1 && t.In(1) == dispatcherType
+}
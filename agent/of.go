@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jsouthworth.net/go/etm/atom"
+	"jsouthworth.net/go/etm/executor"
+	"jsouthworth.net/go/etm/internal/genfn"
+	"jsouthworth.net/go/etm/internal/jobq"
+)
+
+// Of is an agent managing a value of type T. It has the same semantics
+// as Agent but the value is kept in an atom.Of[T] without boxing it in
+// an interface, and actions and watchers are plain typed functions
+// called directly instead of through reflection. Agent is an untyped
+// view of an Of, see Of.Agent.
+type Of[T any] struct {
+	base
+	state *atom.Of[T]
+}
+
+// base is the part of an agent that doesn't depend on the type of its
+// value.
+type base struct {
+	queue *jobq.Queue
+
+	mu         sync.Mutex
+	err        error
+	failed     bool
+	restarting bool
+	held       []interface{}
+
+	lifecycle int32
+	stopped   chan struct{}
+	gen       *generation
+
+	// slots holds a value for each action in a bounded mailbox and
+	// skip counts the oldest actions to drop to make room for newer
+	// ones.
+	slots chan struct{}
+	skip  int32
+
+	stats stats
+	opts  agentOptions
+	// agent is the untyped view of the agent.
+	agent *Agent
+}
+
+// NewOf returns a new agent with an initial value of s. NewOf panics if
+// a Validator is supplied that rejects s.
+func NewOf[T any](s T, options ...Option) *Of[T] {
+	var opts agentOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	a := &Of[T]{}
+	a.agent = &Agent{of: a}
+
+	var atomOptions []atom.Option
+	if opts.equalityFn != nil {
+		atomOptions = append(atomOptions,
+			atom.EqualityFunc(opts.equalityFn))
+	}
+	if opts.validator != nil {
+		atomOptions = append(atomOptions,
+			atom.Validator(opts.validator))
+	}
+	if opts.watcherExec != nil {
+		atomOptions = append(atomOptions,
+			atom.WatcherExecutor(opts.watcherExec))
+	}
+	if opts.watcherErrorFn != nil {
+		fn := opts.watcherErrorFn
+		atomOptions = append(atomOptions,
+			atom.WatcherErrorHandler(func(key, ref interface{}, err error) {
+				fn(key, a.agent, err)
+			}))
+	}
+	if opts.watcherMaxFails > 0 {
+		atomOptions = append(atomOptions,
+			atom.MaxWatcherFailures(opts.watcherMaxFails))
+	}
+	if opts.watcherBuffer > 0 {
+		atomOptions = append(atomOptions,
+			atom.WatcherBuffer(opts.watcherBuffer, opts.watcherOverflow))
+	}
+	if opts.exec == nil {
+		opts.exec = sendExecutor
+		opts.sendExec = sendExecutor
+		opts.sendOffExec = sendOffExecutor
+	}
+
+	if opts.errorMode == 0 {
+		opts.errorMode = Fail
+		if opts.errorHandler != nil {
+			opts.errorMode = Continue
+		}
+	}
+
+	if opts.shutdownMode == 0 {
+		opts.shutdownMode = Drain
+	}
+	if opts.overflow == 0 {
+		opts.overflow = Block
+	}
+
+	a.state = atom.NewOf(s, atomOptions...)
+	a.stopped = make(chan struct{})
+	a.gen = current.Load()
+	a.opts = opts
+	if opts.mailboxSize > 0 {
+		a.slots = make(chan struct{}, opts.mailboxSize)
+	}
+	a.queue = jobq.NewWithExecutor(a.process, opts.exec)
+	return a
+}
+
+// Agent returns the untyped view of a. The view shares the value,
+// queue and watchers of a, it may be passed to Await and AwaitFor and
+// is the agent passed to error handlers. Values passed to the view must
+// be of type T.
+func (a *Of[T]) Agent() *Agent {
+	return a.agent
+}
+
+// Deref returns the current value of the agent.
+func (a *Of[T]) Deref() T {
+	return a.state.Deref()
+}
+
+// Send dispatches an action. It follows the same rules as Agent.Send.
+func (a *Of[T]) Send(fn func(old T) T) *Of[T] {
+	a.check(a.send(context.Background(), a.request(a.opts.sendExec, fn)))
+	return a
+}
+
+// SendWith dispatches an action that is passed a Dispatcher. Sends
+// made through the Dispatcher are held until the action completes and
+// dispatched only if it succeeds. It otherwise follows the same rules
+// as Send.
+func (a *Of[T]) SendWith(fn func(old T, d *Dispatcher) T) *Of[T] {
+	a.check(a.send(context.Background(), a.requestWith(a.opts.sendExec, fn)))
+	return a
+}
+
+// SendOffWith is like SendWith but dispatches an action that may
+// block, see SendOff.
+func (a *Of[T]) SendOffWith(fn func(old T, d *Dispatcher) T) *Of[T] {
+	a.check(a.send(context.Background(), a.requestWith(a.opts.sendOffExec, fn)))
+	return a
+}
+
+// Dispatch dispatches an action, returning an error instead of
+// panicking. It follows the same rules as Agent.Dispatch.
+func (a *Of[T]) Dispatch(fn func(old T) T) error {
+	return a.send(context.Background(), a.request(a.opts.sendExec, fn))
+}
+
+// TrySend dispatches an action without blocking. It follows the same
+// rules as Agent.TrySend.
+func (a *Of[T]) TrySend(fn func(old T) T) error {
+	return a.send(nil, a.request(a.opts.sendExec, fn))
+}
+
+// SendContext dispatches an action, waiting for room in the mailbox
+// until ctx is done. It follows the same rules as Agent.SendContext.
+func (a *Of[T]) SendContext(ctx context.Context, fn func(old T) T) error {
+	return a.send(ctx, a.request(a.opts.sendExec, fn))
+}
+
+// SendOff dispatches an action that may block. It follows the same
+// rules as Agent.SendOff.
+func (a *Of[T]) SendOff(fn func(old T) T) *Of[T] {
+	a.check(a.send(context.Background(), a.request(a.opts.sendOffExec, fn)))
+	return a
+}
+
+// DispatchOff dispatches an action that may block, returning an error
+// instead of panicking. It follows the same rules as Agent.DispatchOff.
+func (a *Of[T]) DispatchOff(fn func(old T) T) error {
+	return a.send(context.Background(), a.request(a.opts.sendOffExec, fn))
+}
+
+// Shutdown stops the agent. It follows the same rules as
+// Agent.Shutdown.
+func (a *Of[T]) Shutdown(ctx context.Context) error {
+	return a.shutdown(ctx)
+}
+
+// Stats returns a snapshot of the agent's activity.
+func (a *Of[T]) Stats() Stats {
+	return a.snapshot()
+}
+
+// Error returns the error that caused the agent to fail or nil if the
+// agent has not failed.
+func (a *Of[T]) Error() error {
+	return a.failure()
+}
+
+// Restart clears the error of a failed agent and resets its value to
+// newState. It follows the same rules as Agent.Restart.
+func (a *Of[T]) Restart(newState T, clearActions bool) error {
+	return a.restart(func() error {
+		_, err := a.state.TryReset(newState)
+		return err
+	}, clearActions)
+}
+
+// SetValidator sets the function used to validate every new value of
+// the agent. It follows the same rules as Agent.SetValidator.
+func (a *Of[T]) SetValidator(fn func(T) error) error {
+	return a.state.SetValidator(fn)
+}
+
+// Watch adds function to be called when the value of the agent changes.
+// Watchers follow the same rules as those added with Agent.Watch.
+func (a *Of[T]) Watch(key interface{}, fn func(key interface{}, a *Of[T], old, new T)) *Of[T] {
+	a.state.Watch(key, func(key interface{}, _ *atom.Of[T], old, new T) {
+		fn(key, a, old, new)
+	})
+	return a
+}
+
+// WatchSync adds a function to be called synchronously when the value
+// of the agent changes. It follows the same rules as Agent.WatchSync.
+func (a *Of[T]) WatchSync(key interface{}, fn func(key interface{}, a *Of[T], old, new T)) *Of[T] {
+	a.state.WatchSync(key, func(key interface{}, _ *atom.Of[T], old, new T) {
+		fn(key, a, old, new)
+	})
+	return a
+}
+
+// Ignore removes the watcher with the passed in key. It follows the same
+// rules as Agent.Ignore.
+func (a *Of[T]) Ignore(key interface{}) *Of[T] {
+	a.state.Ignore(key)
+	return a
+}
+
+// request returns a request for a typed action.
+func (a *Of[T]) request(exec executor.Executor, fn func(T) T) *request[T] {
+	return &request[T]{mailItem: mailItem{exec: exec}, agent: a, update: fn}
+}
+
+// requestWith returns a request for a typed action that is passed a
+// Dispatcher.
+func (a *Of[T]) requestWith(exec executor.Executor, fn func(T, *Dispatcher) T) *request[T] {
+	d := &Dispatcher{}
+	return &request[T]{
+		mailItem: mailItem{exec: exec},
+		agent:    a,
+		update: func(old T) T {
+			// Only the sends of the attempt that is committed
+			// count.
+			d.sends = d.sends[:0]
+			return fn(old, d)
+		},
+		dispatcher: d,
+	}
+}
+
+// requestAny returns a request for an untyped action sent through the
+// Agent view.
+func (a *Of[T]) requestAny(exec executor.Executor, fn interface{}, args []interface{}) *request[T] {
+	f := genfn.MakeGenericE(fn)
+	req := &request[T]{mailItem: mailItem{exec: exec}, agent: a}
+	n := 1
+	if takesDispatcher(fn) {
+		req.dispatcher = &Dispatcher{}
+		n = 2
+	}
+	fnargs := make([]interface{}, n+len(args))
+	copy(fnargs[n:], args)
+	if d := req.dispatcher; d != nil {
+		fnargs[1] = d
+	}
+	req.tryUpdate = func(old T) (T, error) {
+		if d := req.dispatcher; d != nil {
+			// Only the sends of the attempt that is committed
+			// count.
+			d.sends = d.sends[:0]
+		}
+		fnargs[0] = old
+		new, err := f(fnargs...)
+		if err != nil {
+			return old, err
+		}
+		return genfn.Cast[T](new), nil
+	}
+	return req
+}
+
+func (a *Of[T]) process(val interface{}) {
+	switch req := val.(type) {
+	case *request[T]:
+		defer a.actionDone()
+		if a.leaveMailbox(&req.mailItem) {
+			return
+		}
+		if a.discarding() {
+			a.releaseSlot(&req.mailItem)
+			return
+		}
+		if a.hold(req) {
+			return
+		}
+		a.releaseSlot(&req.mailItem)
+		start := time.Now()
+		err := req.run()
+		a.stats.record(time.Since(start), err)
+		if err != nil {
+			a.fail(err)
+			return
+		}
+		req.dispatcher.release()
+	case *awaitRequest:
+		if a.hold(req) {
+			return
+		}
+		close(req.done)
+	case *restartRequest:
+		a.resume(req)
+	case *shutdownRequest:
+		a.stop()
+	}
+}
+
+// resume runs once all actions sent before a restart have been held so
+// that the held actions keep their place ahead of any sent afterwards.
+func (a *Of[T]) resume(req *restartRequest) {
+	a.mu.Lock()
+	held := a.held
+	a.held = nil
+	a.failed = false
+	a.mu.Unlock()
+
+	for _, val := range held {
+		if r, ok := val.(*request[T]); ok {
+			if req.clearActions {
+				a.releaseSlot(&r.mailItem)
+				continue
+			}
+			// Held actions stopped being counted when they
+			// were held.
+			atomic.AddInt64(&a.gen.pending, 1)
+		}
+		a.process(val)
+	}
+}
+
+// request is an action queued for an Of. It holds either a typed
+// action or an untyped one adapted to T.
+type request[T any] struct {
+	mailItem
+	agent     *Of[T]
+	update    func(T) T
+	tryUpdate func(T) (T, error)
+	// dispatcher is passed to an action that takes one.
+	dispatcher *Dispatcher
+}
+
+func (r *request[T]) run() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+	}()
+	if r.update != nil {
+		// Swap panics if the validator rejects the new value.
+		r.agent.state.Swap(r.update)
+		return nil
+	}
+	_, err = r.agent.state.TrySwap(r.tryUpdate)
+	return err
+}
+
+// dispatchHeld queues an action held by a Dispatcher.
+func (r *request[T]) dispatchHeld() {
+	a := r.agent
+	if a.closed() {
+		return
+	}
+	if a.admitNested(&r.mailItem) {
+		a.enqueue(r)
+	}
+}
+
+// The untyped interface used by Agent.
+
+func (a *Of[T]) core() *base {
+	return &a.base
+}
+
+func (a *Of[T]) atom() *atom.Atom {
+	return a.state.Atom()
+}
+
+func (a *Of[T]) sendAny(ctx context.Context, exec executor.Executor, fn interface{}, args []interface{}) error {
+	return a.send(ctx, a.requestAny(exec, fn, args))
+}
+
+func (a *Of[T]) holdAny(exec executor.Executor, fn interface{}, args []interface{}) heldSend {
+	return a.requestAny(exec, fn, args)
+}
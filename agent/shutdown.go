@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrShutdown is returned by Dispatch, and panicked with by Send, when
+// the agent, or every agent, has been shut down.
+var ErrShutdown = errors.New("agent: agent is shut down")
+
+// The lifecycle of an agent.
+const (
+	lifecycleOpen int32 = iota
+	lifecycleClosing
+	lifecycleStopped
+)
+
+// current is the generation that new agents join.
+var current atomic.Pointer[generation]
+
+func init() {
+	current.Store(newGeneration())
+}
+
+// A generation is the set of agents created between two calls to
+// ShutdownAll. Each call stops the agents of the generations before it.
+type generation struct {
+	// pending counts the actions of the generation's agents that have
+	// been queued but not yet run or discarded. Actions held by a
+	// failed agent are not counted.
+	pending int64
+	prev    *generation
+	// closed is closed by ShutdownAll, waking senders blocked on a
+	// full mailbox.
+	closed chan struct{}
+	// drained is closed once the generation is closed and pending
+	// reaches 0.
+	drained chan struct{}
+	once    sync.Once
+}
+
+func newGeneration() *generation {
+	return &generation{
+		closed:  make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+// close must only be called once, by the ShutdownAll that replaced g.
+func (g *generation) close() {
+	close(g.closed)
+	if atomic.LoadInt64(&g.pending) == 0 {
+		g.drain()
+	}
+}
+
+func (g *generation) isClosed() bool {
+	select {
+	case <-g.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *generation) drain() {
+	g.once.Do(func() { close(g.drained) })
+}
+
+// ShutdownMode determines what happens to an agent's queued actions
+// when it is shut down.
+type ShutdownMode int
+
+const (
+	// Drain runs the actions queued before the shutdown.
+	Drain ShutdownMode = iota + 1
+	// Discard drops the actions queued before the shutdown, only the
+	// action already running is allowed to finish.
+	Discard
+)
+
+// Shutdown stops the agent. Sends made after Shutdown is called are
+// rejected with ErrShutdown, see Send and Dispatch, and sends held by
+// actions that complete after it is called are dropped. Actions already
+// queued are run or dropped according to the agent's ShutdownMode.
+// Actions held by a failed agent are dropped.
+//
+// Shutdown waits until the queued actions have been dealt with and
+// returns nil, or until ctx is done and returns its error. In the
+// latter case the agent still shuts down in the background. It is safe
+// to call Shutdown more than once.
+func (a *Agent) Shutdown(ctx context.Context) error {
+	return a.of.core().shutdown(ctx)
+}
+
+func (a *base) shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&a.lifecycle,
+		lifecycleOpen, lifecycleClosing) {
+		a.enqueue(&shutdownRequest{})
+	}
+	select {
+	case <-a.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownAll stops every agent created before it is called, agents
+// created afterwards are unaffected. Like Shutdown sends made after it
+// is called are rejected with ErrShutdown and queued actions are run or
+// dropped according to each agent's ShutdownMode. ShutdownAll waits
+// until none of the agents it stopped has queued actions left, or until
+// ctx is done and returns its error. Actions held by failed agents are
+// not waited for.
+func ShutdownAll(ctx context.Context) error {
+	next := newGeneration()
+	for {
+		next.prev = current.Load()
+		if current.CompareAndSwap(next.prev, next) {
+			break
+		}
+	}
+	next.prev.close()
+	for g := next.prev; g != nil; g = g.prev {
+		select {
+		case <-g.drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type shutdownRequest struct{}
+
+// closed reports whether sends to the agent must be rejected.
+func (a *base) closed() bool {
+	return atomic.LoadInt32(&a.lifecycle) != lifecycleOpen ||
+		a.gen.isClosed()
+}
+
+// discarding reports whether a queued action must be dropped rather
+// than run.
+func (a *base) discarding() bool {
+	if atomic.LoadInt32(&a.lifecycle) == lifecycleStopped {
+		return true
+	}
+	return a.closed() && a.opts.shutdownMode == Discard
+}
+
+// enqueue queues req, counting it if it is an action.
+func (a *base) enqueue(req interface{}) {
+	if _, ok := req.(action); ok {
+		atomic.AddInt64(&a.gen.pending, 1)
+	}
+	a.queue.Enqueue(req)
+}
+
+// actionDone records that a counted action has been run or dropped.
+func (a *base) actionDone() {
+	g := a.gen
+	if atomic.AddInt64(&g.pending, -1) == 0 && g.isClosed() {
+		g.drain()
+	}
+}
+
+// stop runs once every action queued before Shutdown has been dealt
+// with.
+func (a *base) stop() {
+	atomic.StoreInt32(&a.lifecycle, lifecycleStopped)
+	a.mu.Lock()
+	held := a.held
+	a.held = nil
+	a.mu.Unlock()
+	for _, val := range held {
+		switch req := val.(type) {
+		case action:
+			a.releaseSlot(req.mail())
+		case *awaitRequest:
+			close(req.done)
+		}
+	}
+	close(a.stopped)
+}
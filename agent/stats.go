@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyWeight is the weight, as a power of two, given to the past
+// when updating the rolling action latency. Each new action contributes
+// 1/8th of the average.
+const latencyWeight = 3
+
+// Stats is a snapshot of an agent's activity.
+type Stats struct {
+	// Pending is the number of requests queued for the agent. This
+	// includes the markers queued by Await, Restart and Shutdown.
+	Pending int
+	// Held is the number of requests held by a failed agent.
+	Held int
+	// Processed is the number of actions that have been run,
+	// whether they failed or not.
+	Processed uint64
+	// Failed is the number of actions that have failed.
+	Failed uint64
+	// Running reports whether the agent is currently processing its
+	// queue on one of the executor's goroutines.
+	Running bool
+	// Latency is a moving average of the time taken to run an
+	// action.
+	Latency time.Duration
+}
+
+type stats struct {
+	processed uint64
+	failed    uint64
+	latency   int64
+}
+
+// Stats returns a snapshot of the agent's activity. The fields are read
+// independently so they may not be consistent with each other while
+// the agent is busy.
+func (a *Agent) Stats() Stats {
+	return a.of.core().snapshot()
+}
+
+func (a *base) snapshot() Stats {
+	a.mu.Lock()
+	held := len(a.held)
+	a.mu.Unlock()
+	return Stats{
+		Pending:   a.queue.Len(),
+		Held:      held,
+		Processed: atomic.LoadUint64(&a.stats.processed),
+		Failed:    atomic.LoadUint64(&a.stats.failed),
+		Running:   a.queue.Running(),
+		Latency:   time.Duration(atomic.LoadInt64(&a.stats.latency)),
+	}
+}
+
+// record must only be called while processing the agent's queue, the
+// rolling latency is not updated atomically.
+func (s *stats) record(took time.Duration, err error) {
+	atomic.AddUint64(&s.processed, 1)
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+	}
+	old := atomic.LoadInt64(&s.latency)
+	new := int64(took)
+	if old != 0 {
+		new = old + (new-old)>>latencyWeight
+	}
+	atomic.StoreInt64(&s.latency, new)
+}
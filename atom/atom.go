@@ -7,41 +7,52 @@
 package atom
 
 import (
-	"unsafe"
+	"context"
+	"fmt"
+	"time"
 
 	"jsouthworth.net/go/dyn"
+	"jsouthworth.net/go/etm"
+	"jsouthworth.net/go/etm/executor"
 	"jsouthworth.net/go/etm/internal/genfn"
-	"jsouthworth.net/go/etm/internal/unsafe/ref"
+	"jsouthworth.net/go/etm/internal/meta"
 	"jsouthworth.net/go/etm/internal/watchers"
 )
 
+// ErrInvalidState is wrapped by the error reported when a validator
+// rejects a new value of an atom. It is etm.ErrInvalidState.
+var ErrInvalidState = etm.ErrInvalidState
+
+// RetryError is returned when an update could not be committed within
+// the atom's retry limit because of contention with other updaters.
+type RetryError struct {
+	Attempts int
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("atom: update not committed after %d attempts",
+		e.Attempts)
+}
+
 // Atom is a mechanism to manage a single piece of shared state synchronously.
 type Atom struct {
-	state    ref.Ref
-	watchers *watchers.Watchers
+	of   untyped
+	meta meta.Meta
 }
 
-// New returns a new atom with an initial value of s.
+// New returns a new atom with an initial value of s. New panics if a
+// Validator is supplied that rejects s.
 func New(s interface{}, options ...Option) *Atom {
-	var opts atomOptions
-
-	//Default to dyn's equal function
-	EqualityFunc(dyn.Equal)(&opts)
-
-	for _, option := range options {
-		option(&opts)
-	}
-
-	return &Atom{
-		state:    ref.Make(unsafe.Pointer(&s)),
-		watchers: watchers.New(opts.equalityFn),
-	}
+	of := &Of[interface{}]{}
+	a := &Atom{of: of}
+	of.view.Store(a)
+	of.init(a, s, options)
+	return a
 }
 
 // Deref returns the current value of the atom.
 func (a *Atom) Deref() interface{} {
-	out := a.load()
-	return *out
+	return a.of.derefAny()
 }
 
 // Swap updates the atom synchronously. The atom's value will be updated
@@ -49,36 +60,153 @@ func (a *Atom) Deref() interface{} {
 // func(old aT, args...) rT where aT is the old type of the atom and rT
 // is the desired type of the atom.
 //
+// If a validator is set it is applied to the new value before it is
+// committed. Swap panics with an error wrapping ErrInvalidState if the
+// validator rejects the value, leaving the atom unchanged.
+//
 // Passing a func(...interface{})interface{} avoids reflect based
 // function application allow faster execution at the expense of
 // some clarity.
 func (a *Atom) Swap(fn interface{}, args ...interface{}) interface{} {
 	args = dyn.PrependArg(nil, args...)
 	f := genfn.MakeGeneric(fn)
-	for {
-		old := a.load()
-		args[0] = *old
-		new := f(args...)
-		if a.compareAndSwap(old, &new) {
-			a.notifyWatchers(*old, new)
-			return new
-		}
-	}
+	_, new := a.of.swapAny(func(old interface{}) interface{} {
+		args[0] = old
+		return f(args...)
+	})
+	return new
+}
+
+// SwapVals is like Swap but returns both the value that was replaced
+// and the new value.
+func (a *Atom) SwapVals(fn interface{}, args ...interface{}) (interface{}, interface{}) {
+	args = dyn.PrependArg(nil, args...)
+	f := genfn.MakeGeneric(fn)
+	return a.of.swapAny(func(old interface{}) interface{} {
+		args[0] = old
+		return f(args...)
+	})
+}
+
+// TrySwap is like Swap but takes a function that may fail. The function
+// is of the form func(old aT, args...) (rT, error). If the function
+// returns an error the CAS loop is aborted, nothing is committed, the
+// watchers are not notified and TrySwap returns the value the function
+// was applied to along with the error. A validator rejecting the new
+// value is reported in the same way rather than with a panic.
+//
+// Passing a func(...interface{}) (interface{}, error) avoids reflect
+// based function application allow faster execution at the expense of
+// some clarity.
+func (a *Atom) TrySwap(fn interface{}, args ...interface{}) (interface{}, error) {
+	args = dyn.PrependArg(nil, args...)
+	f := genfn.MakeGenericE(fn)
+	return a.of.trySwapAny(nil, func(old interface{}) (interface{}, error) {
+		args[0] = old
+		return f(args...)
+	})
 }
 
-// Reset forcibly updates the value of the atom to new.
+// SwapContext is like TrySwap but bounds the time spent retrying under
+// contention. It takes a function of the form func(old aT, args...) rT
+// or func(old aT, args...) (rT, error). If ctx is done before the update
+// commits SwapContext returns ctx.Err(). If the atom was created with
+// MaxRetries and that many retries have failed SwapContext returns a
+// *RetryError. Between failed attempts it waits as directed by the
+// atom's Backoff. On error the atom is left unchanged and the current
+// value is returned with the error.
+//
+// Passing a func(...interface{}) (interface{}, error) avoids reflect
+// based function application allow faster execution at the expense of
+// some clarity.
+func (a *Atom) SwapContext(ctx context.Context, fn interface{}, args ...interface{}) (interface{}, error) {
+	args = dyn.PrependArg(nil, args...)
+	f := genfn.MakeGenericE(fn)
+	return a.of.trySwapAny(ctx, func(old interface{}) (interface{}, error) {
+		args[0] = old
+		return f(args...)
+	})
+}
+
+// Reset forcibly updates the value of the atom to new. Reset panics
+// with an error wrapping ErrInvalidState if the validator rejects new.
 func (a *Atom) Reset(new interface{}) interface{} {
-	old := a.load()
-	a.state.Set(unsafe.Pointer(&new))
-	a.notifyWatchers(*old, new)
+	_, new = a.ResetVals(new)
 	return new
 }
 
+// ResetVals is like Reset but returns both the value that was replaced
+// and the new value.
+func (a *Atom) ResetVals(new interface{}) (interface{}, interface{}) {
+	old, new, err := a.of.resetAny(new)
+	if err != nil {
+		panic(err)
+	}
+	return old, new
+}
+
+// TryReset is like Reset but returns an error wrapping ErrInvalidState
+// instead of panicking if the validator rejects new. On error the atom
+// is left unchanged and its current value is returned.
+func (a *Atom) TryReset(new interface{}) (interface{}, error) {
+	_, new, err := a.of.resetAny(new)
+	return new, err
+}
+
+// CompareAndSet sets the value of the atom to new only if the current
+// value is equal to expected. Equality is determined by the atom's
+// equality function, see EqualityFunc, rather than by identity. It
+// reports whether the value was set and notifies the watchers when it
+// was. CompareAndSet panics with an error wrapping ErrInvalidState if
+// the validator rejects new.
+func (a *Atom) CompareAndSet(expected, new interface{}) bool {
+	set, err := a.of.compareAndSetAny(expected, new)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// TryCompareAndSet is like CompareAndSet but returns an error wrapping
+// ErrInvalidState instead of panicking if the validator rejects new.
+func (a *Atom) TryCompareAndSet(expected, new interface{}) (bool, error) {
+	return a.of.compareAndSetAny(expected, new)
+}
+
+// SetValidator sets the function used to validate every new value of
+// the atom. The validator returns a non-nil error to reject a value.
+// The current value is validated first and if it is rejected the
+// validator is not set and the error is returned. Passing nil removes
+// the validator.
+func (a *Atom) SetValidator(fn func(interface{}) error) error {
+	return a.of.setValidatorAny(fn)
+}
+
+// Meta returns the metadata of the atom.
+func (a *Atom) Meta() interface{} {
+	return a.meta.Load()
+}
+
+// ResetMeta replaces the metadata of the atom with m.
+func (a *Atom) ResetMeta(m interface{}) interface{} {
+	return a.meta.Reset(m)
+}
+
+// AlterMeta updates the metadata of the atom to the result of applying
+// fn to the current metadata. AlterMeta takes a function of the form
+// func(old mT, args...) rT. Changing the metadata does not notify the
+// watchers.
+func (a *Atom) AlterMeta(fn interface{}, args ...interface{}) interface{} {
+	return a.meta.Alter(genfn.MakeGeneric(fn), args)
+}
+
 // Watch adds function to be called when the value of the atom changes.
 //
 // Watchers must be functions of the following form:
 // func(key kT, atom *Atom, old oT, new nT)
-// Watchers may return a value or not but any returned value is ignored.
+// Watchers may return an error, alone or after a value, which is passed
+// to the WatcherErrorHandler along with the error of a watcher that
+// panics. Any other returned value is ignored.
 // The key type must be the type of the key passed in when the watcher
 // is added, the Value types must be the type of the atom. If the atom
 // can take arbitrary types then the watcher should take type interface{}.
@@ -88,20 +216,45 @@ func (a *Atom) Reset(new interface{}) interface{} {
 //
 // All watchers are called asynchronously when the atom changes, this means
 // that one should not deref the atom in the watcher but should used the
-// passed in old and new values. Dispatches to the watchers are queued so
-// the set of watchers for a given update are called then the set for the
-// next and so on.
+// passed in old and new values. Each watcher has its own queue of
+// changes so it sees the changes in the order they were made, even
+// when they are made concurrently, and a slow watcher doesn't hold up
+// the others. See WatcherBuffer to limit the changes queued for a
+// watcher.
 //
 // Passing a func(...interface{})interface{} avoids reflect based
 // function application allow faster execution at the expense of
 // some clarity.
 func (a *Atom) Watch(key interface{}, fn interface{}, args ...interface{}) *Atom {
-	f := genfn.MakeGeneric(fn)
+	f := watchers.Fn(fn)
 	watcher := &watchers.Watcher{
 		Fn:   f,
 		Args: args,
+		Ref:  a,
 	}
-	a.watchers.Add(key, watcher)
+	a.of.watcherSet().Add(key, watcher)
+	return a
+}
+
+// WatchSync adds a function to be called when the value of the atom
+// changes like Watch, but the function is called synchronously by the
+// goroutine that changed the atom before Swap, Reset or the other
+// update methods return. Since concurrent updates call it from their
+// own goroutines it may be called concurrently and may see changes out
+// of order. Its errors and panics are handled like those of other
+// watchers, they never fail the update.
+//
+// WatchSync shares its keys with Watch, adding a watcher replaces any
+// watcher with the same key and Ignore removes either kind.
+func (a *Atom) WatchSync(key interface{}, fn interface{}, args ...interface{}) *Atom {
+	f := watchers.Fn(fn)
+	watcher := &watchers.Watcher{
+		Fn:   f,
+		Args: args,
+		Ref:  a,
+		Sync: true,
+	}
+	a.of.watcherSet().Add(key, watcher)
 	return a
 }
 
@@ -110,27 +263,34 @@ func (a *Atom) Watch(key interface{}, fn interface{}, args ...interface{}) *Atom
 // immediately so if a watcher removes its self, the next update to the
 // atom will not contain the watcher.
 func (a *Atom) Ignore(key interface{}) *Atom {
-	a.watchers.Delete(key)
+	a.of.watcherSet().Delete(key)
 	return a
 }
 
-func (a *Atom) load() *interface{} {
-	return (*interface{})(a.state.Load())
-}
-
-func (a *Atom) compareAndSwap(old, new *interface{}) bool {
-	return a.state.CompareAndSwap(
-		unsafe.Pointer(old), unsafe.Pointer(new))
+// AddWatch is like Watch but doesn't return the atom, see etm.Watchable.
+func (a *Atom) AddWatch(key interface{}, fn interface{}, args ...interface{}) {
+	a.Watch(key, fn, args...)
 }
 
-func (a *Atom) notifyWatchers(old, new interface{}) {
-	a.watchers.Notify(a, old, new)
+// RemoveWatch is like Ignore but doesn't return the atom, see
+// etm.Watchable.
+func (a *Atom) RemoveWatch(key interface{}) {
+	a.Ignore(key)
 }
 
 type Option func(*atomOptions)
 
 type atomOptions struct {
 	equalityFn func(interface{}, interface{}) bool
+	validator  func(interface{}) error
+	maxRetries int
+	backoff    func(attempt int) time.Duration
+	exec       executor.Executor
+
+	watcherBuffer   int
+	watcherOverflow Overflow
+	watcherErrorFn  func(key, ref interface{}, err error)
+	watcherMaxFails int
 }
 
 func EqualityFunc(fn func(a, b interface{}) bool) Option {
@@ -138,3 +298,105 @@ func EqualityFunc(fn func(a, b interface{}) bool) Option {
 		opts.equalityFn = fn
 	}
 }
+
+// WatcherExecutor sets the executor the atom's watchers are run on.
+// The default runs them on new goroutines. Whatever the executor, each
+// watcher is called for one change at a time, in the order the changes
+// were queued for it.
+func WatcherExecutor(exec executor.Executor) Option {
+	return func(opts *atomOptions) {
+		opts.exec = exec
+	}
+}
+
+// Overflow determines what happens to a change for a watcher whose
+// buffer is full, see WatcherBuffer.
+type Overflow int
+
+const (
+	// Block makes the update that passes the change to the watcher,
+	// usually the one that made it, wait until there is room in the
+	// watcher's buffer.
+	Block Overflow = iota + 1
+	// Drop drops the change, the watcher never sees it.
+	Drop
+	// Coalesce merges the change with the others that didn't fit in
+	// the buffer. Once there is room the watcher sees a single change
+	// from the old value of the first change that didn't fit to the
+	// new value of the last.
+	Coalesce
+)
+
+// WatcherBuffer limits the number of changes waiting to be delivered to
+// each of the atom's watchers to n and sets what happens to changes
+// that don't fit. The default is an unlimited buffer. A watcher that
+// updates the atom it is watching must not use the Block policy as it
+// may wait for itself.
+func WatcherBuffer(n int, policy Overflow) Option {
+	return func(opts *atomOptions) {
+		opts.watcherBuffer = n
+		opts.watcherOverflow = policy
+	}
+}
+
+// WatcherErrorHandler sets a function to be called when one of the
+// atom's watchers returns an error or panics. It is passed the watcher's
+// key, the reference the watcher was passed and the error. The error
+// from a panic wraps etm.ErrWatcherPanicked. Without a handler the
+// errors are ignored.
+func WatcherErrorHandler(fn func(key, ref interface{}, err error)) Option {
+	return func(opts *atomOptions) {
+		opts.watcherErrorFn = fn
+	}
+}
+
+// MaxWatcherFailures removes a watcher once it has failed, by returning
+// an error or panicking, n times in a row. The default, 0, never
+// removes watchers.
+func MaxWatcherFailures(n int) Option {
+	return func(opts *atomOptions) {
+		opts.watcherMaxFails = n
+	}
+}
+
+// Validator sets the function used to validate every new value of the
+// atom. See SetValidator.
+func Validator(fn func(interface{}) error) Option {
+	return func(opts *atomOptions) {
+		opts.validator = fn
+	}
+}
+
+// MaxRetries limits the number of times SwapContext retries an update
+// that failed to commit because of contention. Zero, the default, means
+// no limit.
+func MaxRetries(n int) Option {
+	return func(opts *atomOptions) {
+		opts.maxRetries = n
+	}
+}
+
+// Backoff sets the function SwapContext uses to decide how long to wait
+// after a failed attempt before trying again. It is passed the number
+// of attempts made so far. By default SwapContext retries immediately.
+func Backoff(fn func(attempt int) time.Duration) Option {
+	return func(opts *atomOptions) {
+		opts.backoff = fn
+	}
+}
+
+// ExponentialBackoff returns a backoff function, suitable for Backoff,
+// that waits base after the first failed attempt and doubles the wait
+// after each subsequent one up to max.
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
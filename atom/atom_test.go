@@ -1,9 +1,18 @@
 package atom
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"jsouthworth.net/go/etm"
+	"jsouthworth.net/go/etm/executor"
+	"jsouthworth.net/go/immutable/hashmap"
 )
 
 func TestSwap(t *testing.T) {
@@ -180,3 +189,868 @@ func TestWatchArgs(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestOf(t *testing.T) {
+	a := NewOf(1)
+	if b := a.Deref(); b != 1 {
+		t.Fatalf("got %v, wanted %v\n", b, 1)
+	}
+	a.Swap(func(cur int) int {
+		return cur + 1
+	})
+	if b := a.Deref(); b != 2 {
+		t.Fatalf("got %v, wanted %v\n", b, 2)
+	}
+	a.Reset(10)
+	if b := a.Deref(); b != 10 {
+		t.Fatalf("got %v, wanted %v\n", b, 10)
+	}
+}
+
+func TestOfAtom(t *testing.T) {
+	a := NewOf(1)
+	v := a.Atom()
+	if v != a.Atom() {
+		t.Fatal("got a different view")
+	}
+	changes := make(chan interface{}, 1)
+	v.Watch("foo", func(key string, ref *Atom, old, new int) {
+		changes <- ref
+	})
+	v.Swap(func(cur, inc int) int { return cur + inc }, 1)
+	if got := a.Deref(); got != 2 {
+		t.Fatalf("got %v, wanted %v\n", got, 2)
+	}
+	if ref := <-changes; ref != v {
+		t.Fatalf("got %v, wanted %v\n", ref, v)
+	}
+	a.Reset(3)
+	if got := v.Deref(); got != 3 || <-changes != v {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	if err := v.SetValidator(func(val interface{}) error {
+		if val.(int) < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.TryReset(-1); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("got %v, wanted %v\n", err, ErrInvalidState)
+	}
+	if set, err := v.TryCompareAndSet(3, 4); !set || err != nil {
+		t.Fatalf("got %v, %v, wanted true, nil\n", set, err)
+	}
+	if got := a.Deref(); got != 4 {
+		t.Fatalf("got %v, wanted %v\n", got, 4)
+	}
+}
+
+func TestOfConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	a := NewOf(1)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			a.Swap(func(cur int) int {
+				return i + cur
+			})
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	if val := a.Deref(); val != 4951 {
+		t.Fatalf("didn't get expected result, got %v, wanted 4951", val)
+	}
+}
+
+func TestOfWatch(t *testing.T) {
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(n)
+	a := NewOf[error](nil)
+	a.Watch("foo", func(key interface{}, r *Of[error], old, new error) {
+		if r != a {
+			t.Error("watcher got the wrong atom")
+		}
+		wg.Done()
+	})
+	for i := 0; i < n; i++ {
+		a.Reset(fmt.Errorf("%d", i))
+	}
+	wg.Wait()
+	a.Ignore("foo")
+}
+
+func TestValidator(t *testing.T) {
+	errNegative := errors.New("negative")
+	nonNegative := func(v interface{}) error {
+		if v.(int) < 0 {
+			return errNegative
+		}
+		return nil
+	}
+	a := New(1, Validator(nonNegative))
+
+	mustPanicInvalid := func(fn func()) {
+		t.Helper()
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, ErrInvalidState) ||
+				!errors.Is(err, errNegative) {
+				t.Fatalf("got %v, wanted %v\n", err, ErrInvalidState)
+			}
+		}()
+		fn()
+	}
+	mustPanicInvalid(func() {
+		a.Swap(func(cur int) int { return cur - 10 })
+	})
+	mustPanicInvalid(func() { a.Reset(-1) })
+	if b := a.Deref(); b != 1 {
+		t.Fatalf("got %v, wanted %v\n", b, 1)
+	}
+
+	if err := a.SetValidator(nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Reset(-1)
+	if err := a.SetValidator(nonNegative); !errors.Is(err, errNegative) {
+		t.Fatalf("got %v, wanted %v\n", err, errNegative)
+	}
+	a.Reset(-2)
+	if b := a.Deref(); b != -2 {
+		t.Fatalf("got %v, wanted %v\n", b, -2)
+	}
+}
+
+func TestTryReset(t *testing.T) {
+	errNegative := errors.New("negative")
+	a := New(1, Validator(func(v interface{}) error {
+		if v.(int) < 0 {
+			return errNegative
+		}
+		return nil
+	}))
+	got, err := a.TryReset(-1)
+	if !errors.Is(err, ErrInvalidState) || !errors.Is(err, errNegative) {
+		t.Fatalf("got %v, wanted %v\n", err, ErrInvalidState)
+	}
+	if got != 1 || a.Deref() != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+	set, err := a.TryCompareAndSet(1, -1)
+	if set || !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("got %v, %v, wanted false, %v\n", set, err, ErrInvalidState)
+	}
+	if got, err = a.TryReset(2); err != nil || got != 2 {
+		t.Fatalf("got %v, %v, wanted %v, nil\n", got, err, 2)
+	}
+	if set, err = a.TryCompareAndSet(2, 3); !set || err != nil {
+		t.Fatalf("got %v, %v, wanted true, nil\n", set, err)
+	}
+	if set, err = a.TryCompareAndSet(2, 4); set || err != nil {
+		t.Fatalf("got %v, %v, wanted false, nil\n", set, err)
+	}
+	if v := a.Deref(); v != 3 {
+		t.Fatalf("got %v, wanted %v\n", v, 3)
+	}
+}
+
+func TestOfValidator(t *testing.T) {
+	a := NewOf(1)
+	a.SetValidator(func(v int) error {
+		if v > 10 {
+			return errors.New("too big")
+		}
+		return nil
+	})
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrInvalidState) {
+			t.Fatalf("got %v, wanted %v\n", err, ErrInvalidState)
+		}
+		if b := a.Deref(); b != 1 {
+			t.Fatalf("got %v, wanted %v\n", b, 1)
+		}
+	}()
+	a.Swap(func(cur int) int { return cur + 10 })
+}
+
+func TestTrySwap(t *testing.T) {
+	errOdd := errors.New("odd")
+	evenOnly := func(cur, inc int) (int, error) {
+		if (cur+inc)%2 != 0 {
+			return 0, errOdd
+		}
+		return cur + inc, nil
+	}
+	notified := make(chan int, 10)
+	a := New(0).Watch("foo", func(key string, a *Atom, old, new int) {
+		notified <- new
+	})
+
+	got, err := a.TrySwap(evenOnly, 2)
+	if err != nil || got != 2 {
+		t.Fatalf("got %v, %v, wanted %v, nil\n", got, err, 2)
+	}
+	got, err = a.TrySwap(evenOnly, 1)
+	if err != errOdd || got != 2 {
+		t.Fatalf("got %v, %v, wanted %v, %v\n", got, err, 2, errOdd)
+	}
+	got, err = a.TrySwap(func(args ...interface{}) (interface{}, error) {
+		return args[0].(int) + args[1].(int), nil
+	}, 4)
+	if err != nil || got != 6 {
+		t.Fatalf("got %v, %v, wanted %v, nil\n", got, err, 6)
+	}
+	if n := <-notified; n != 2 {
+		t.Fatalf("got %v, wanted %v\n", n, 2)
+	}
+	if n := <-notified; n != 6 {
+		t.Fatalf("got %v, wanted %v\n", n, 6)
+	}
+
+	a.SetValidator(func(v interface{}) error {
+		if v.(int) > 6 {
+			return errors.New("too big")
+		}
+		return nil
+	})
+	if _, err := a.TrySwap(evenOnly, 2); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("got %v, wanted %v\n", err, ErrInvalidState)
+	}
+}
+
+func TestSwapReturningError(t *testing.T) {
+	errBoom := errors.New("boom")
+	a := New(0)
+	a.Swap(func(cur int) (int, error) {
+		return cur + 1, nil
+	})
+	if b := a.Deref(); b != 1 {
+		t.Fatalf("got %v, wanted %v\n", b, 1)
+	}
+	defer func() {
+		if err := recover(); err != errBoom {
+			t.Fatalf("got %v, wanted %v\n", err, errBoom)
+		}
+	}()
+	a.Swap(func(cur int) (int, error) {
+		return 0, errBoom
+	})
+}
+
+func TestSwapVals(t *testing.T) {
+	a := New(1)
+	old, new := a.SwapVals(func(cur, inc int) int {
+		return cur + inc
+	}, 2)
+	if old != 1 || new != 3 {
+		t.Fatalf("got %v, %v, wanted %v, %v\n", old, new, 1, 3)
+	}
+	old, new = a.ResetVals(10)
+	if old != 3 || new != 10 {
+		t.Fatalf("got %v, %v, wanted %v, %v\n", old, new, 3, 10)
+	}
+}
+
+func TestResetValsConcurrent(t *testing.T) {
+	const n = 1000
+	a := New(-1)
+	olds := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			old, _ := a.ResetVals(i)
+			olds <- old.(int)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	close(olds)
+
+	// Every value must have been replaced exactly once except the
+	// final value of the atom.
+	seen := make(map[int]bool)
+	for old := range olds {
+		if seen[old] {
+			t.Fatalf("value %v was replaced twice", old)
+		}
+		seen[old] = true
+	}
+	if seen[a.Deref().(int)] || len(seen) != n {
+		t.Fatal("replaced values don't form a history of the atom")
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	notified := make(chan int, 1)
+	a := New([]int{1, 2}).Watch("foo", func(key string, a *Atom, old, new []int) {
+		notified <- len(new)
+	})
+	if a.CompareAndSet([]int{1}, []int{3}) {
+		t.Fatal("set with an unequal expected value")
+	}
+	// A distinct but equal slice must match.
+	if !a.CompareAndSet([]int{1, 2}, []int{1, 2, 3}) {
+		t.Fatal("didn't set with an equal expected value")
+	}
+	if n := <-notified; n != 3 {
+		t.Fatalf("got %v, wanted %v\n", n, 3)
+	}
+
+	b := New(1, EqualityFunc(func(x, y interface{}) bool {
+		return x.(int)%10 == y.(int)%10
+	}))
+	if !b.CompareAndSet(11, 2) {
+		t.Fatal("didn't use the atom's equality function")
+	}
+	if v := b.Deref(); v != 2 {
+		t.Fatalf("got %v, wanted %v\n", v, 2)
+	}
+}
+
+func TestCompareAndSetConcurrent(t *testing.T) {
+	const n = 100
+	a := NewOf(0)
+	var wg sync.WaitGroup
+	var won int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			if a.CompareAndSet(0, 1) {
+				atomic.AddInt32(&won, 1)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("got %v winners, wanted %v\n", won, 1)
+	}
+}
+
+func TestSwapContext(t *testing.T) {
+	a := New(1)
+	got, err := a.SwapContext(context.Background(), func(cur, inc int) int {
+		return cur + inc
+	}, 1)
+	if err != nil || got != 2 {
+		t.Fatalf("got %v, %v, wanted %v, nil\n", got, err, 2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got, err = a.SwapContext(ctx, func(cur int) int {
+		t.Fatal("update ran with a done context")
+		return cur
+	})
+	if err != context.Canceled || got != 2 {
+		t.Fatalf("got %v, %v, wanted %v, %v\n", got, err, 2, context.Canceled)
+	}
+}
+
+func TestSwapContextRetries(t *testing.T) {
+	var backoffs []int
+	a := New(0, MaxRetries(3), Backoff(func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Microsecond
+	}))
+	attempts := 0
+	_, err := a.SwapContext(context.Background(), func(cur int) int {
+		attempts++
+		// Force contention by changing the atom underneath the update.
+		a.Reset(cur + 1)
+		return cur
+	})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 4 {
+		t.Fatalf("got %v, wanted a *RetryError after 4 attempts", err)
+	}
+	if attempts != 4 || len(backoffs) != 3 {
+		t.Fatalf("got %v attempts and %v backoffs, wanted 4 and 3",
+			attempts, len(backoffs))
+	}
+}
+
+func TestSwapContextBackoffCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a := New(0, Backoff(func(int) time.Duration { return time.Hour }))
+	_, err := a.SwapContext(ctx, func(cur int) int {
+		a.Reset(cur + 1)
+		return cur
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, wanted %v\n", err, context.DeadlineExceeded)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Millisecond, 5*time.Millisecond)
+	expected := []time.Duration{
+		time.Millisecond,
+		2 * time.Millisecond,
+		4 * time.Millisecond,
+		5 * time.Millisecond,
+		5 * time.Millisecond,
+	}
+	for i, want := range expected {
+		if got := backoff(i + 1); got != want {
+			t.Fatalf("attempt %v: got %v, wanted %v\n", i+1, got, want)
+		}
+	}
+}
+
+var (
+	_ etm.Deref       = (*Atom)(nil)
+	_ etm.Watchable   = (*Atom)(nil)
+	_ etm.Validatable = (*Atom)(nil)
+	_ etm.MetaHolder  = (*Atom)(nil)
+)
+
+func TestMeta(t *testing.T) {
+	a := New(0)
+	if m := a.Meta(); m != nil {
+		t.Fatalf("got %v, wanted nil\n", m)
+	}
+	a.ResetMeta(1)
+	a.AlterMeta(func(cur, inc int) int {
+		return cur + inc
+	}, 2)
+	if m := a.Meta(); m != 3 {
+		t.Fatalf("got %v, wanted %v\n", m, 3)
+	}
+}
+
+func TestWatcherExecutor(t *testing.T) {
+	var got []int
+	a := New(0, WatcherExecutor(executor.Synchronous))
+	a.Watch("a", func(key string, a *Atom, old, new int) {
+		got = append(got, new)
+	})
+	a.Watch("b", func(key string, a *Atom, old, new int) {
+		got = append(got, -new)
+	})
+	a.Reset(1)
+	// The synchronous executor has run both watchers by the time Reset
+	// returns.
+	if len(got) != 2 || got[0]+got[1] != 0 {
+		t.Fatalf("got %v, wanted both watchers to have run", got)
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+	a := New(0)
+	release := make(chan struct{})
+	a.Watch("slow", func(key string, a *Atom, old, new int) {
+		<-release
+	})
+	var mu sync.Mutex
+	var got []int
+	done := make(chan struct{})
+	a.Watch("fast", func(key string, a *Atom, old, new int) {
+		mu.Lock()
+		got = append(got, new)
+		if len(got) == 10 {
+			close(done)
+		}
+		mu.Unlock()
+	})
+	for i := 1; i <= 10; i++ {
+		a.Reset(i)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fast watcher was held up by the slow one")
+	}
+	close(release)
+	for i, v := range got {
+		if v != i+1 {
+			t.Fatalf("changes delivered out of order: %v", got)
+		}
+	}
+}
+
+func TestWatchConcurrentOrder(t *testing.T) {
+	const goroutines, swaps = 8, 1000
+	a := New(0)
+	var wg, watched sync.WaitGroup
+	errs := make(chan error, 2)
+	watched.Add(2)
+	// A sync watcher widens the gap between a change being committed
+	// and it being passed to the other watchers.
+	a.WatchSync("sync", func(key string, a *Atom, old, new int) {
+		runtime.Gosched()
+	})
+	for _, key := range []string{"a", "b"} {
+		prev := 0
+		a.Watch(key, func(key string, a *Atom, old, new int) {
+			if old != prev && len(errs) == 0 {
+				errs <- fmt.Errorf("%s: got old %v, wanted %v", key, old, prev)
+			}
+			prev = new
+			if new == goroutines*swaps {
+				watched.Done()
+			}
+		})
+	}
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < swaps; j++ {
+				a.Swap(func(cur int) int { return cur + 1 })
+			}
+		}()
+	}
+	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		watched.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout while waiting for the watchers")
+	}
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// watchBlocked adds a watcher that records the changes it sees and
+// waits for release before returning from the first one.
+func watchBlocked(a *Atom) (started, release chan struct{}, changes chan [2]int) {
+	started = make(chan struct{})
+	release = make(chan struct{})
+	changes = make(chan [2]int, 10)
+	a.Watch("foo", func(key string, a *Atom, old, new int) {
+		changes <- [2]int{old, new}
+		if old == 0 {
+			close(started)
+			<-release
+		}
+	})
+	return started, release, changes
+}
+
+func TestWatcherBufferDrop(t *testing.T) {
+	a := New(0, WatcherBuffer(1, Drop))
+	started, release, changes := watchBlocked(a)
+	a.Reset(1)
+	<-started
+	for i := 2; i <= 5; i++ {
+		a.Reset(i)
+	}
+	close(release)
+	if got := <-changes; got != [2]int{0, 1} {
+		t.Fatalf("got %v, wanted %v", got, [2]int{0, 1})
+	}
+	// Changes are delivered again once the buffer has room.
+	for i := 6; i < 1000; i++ {
+		a.Reset(i)
+		select {
+		case got := <-changes:
+			if got != [2]int{i - 1, i} {
+				t.Fatalf("got %v, wanted %v", got, [2]int{i - 1, i})
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("watcher never saw another change")
+}
+
+func TestWatcherBufferCoalesce(t *testing.T) {
+	a := New(0, WatcherBuffer(1, Coalesce))
+	started, release, changes := watchBlocked(a)
+	a.Reset(1)
+	<-started
+	for i := 2; i <= 5; i++ {
+		a.Reset(i)
+	}
+	close(release)
+	for _, want := range [][2]int{{0, 1}, {1, 5}} {
+		if got := <-changes; got != want {
+			t.Fatalf("got %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestWatcherBufferCoalesceUnchanged(t *testing.T) {
+	a := New(0, WatcherBuffer(1, Coalesce))
+	started, release, changes := watchBlocked(a)
+	a.Reset(1)
+	<-started
+	// The merged change from 1 to 2 and back is not a change.
+	a.Reset(2)
+	a.Reset(1)
+	close(release)
+	if got, want := <-changes, [2]int{0, 1}; got != want {
+		t.Fatalf("got %v, wanted %v", got, want)
+	}
+	a.Reset(3)
+	if got, want := <-changes, [2]int{1, 3}; got != want {
+		t.Fatalf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestWatcherBufferBlock(t *testing.T) {
+	a := New(0, WatcherBuffer(1, Block))
+	started, release, changes := watchBlocked(a)
+	a.Reset(1)
+	<-started
+	reset := make(chan struct{})
+	go func() {
+		a.Reset(2)
+		close(reset)
+	}()
+	select {
+	case <-reset:
+		t.Fatal("reset didn't wait for room in the watcher's buffer")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-reset
+	for _, want := range [][2]int{{0, 1}, {1, 2}} {
+		if got := <-changes; got != want {
+			t.Fatalf("got %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestWatchSync(t *testing.T) {
+	a := New(0)
+	var got []int
+	a.WatchSync("sync", func(key string, a *Atom, old, new int) {
+		got = append(got, new)
+	})
+	a.Swap(func(cur int) int { return cur + 1 })
+	a.Reset(5)
+	a.Reset(5)
+	if len(got) != 2 || got[0] != 1 || got[1] != 5 {
+		t.Fatalf("got %v, wanted %v", got, []int{1, 5})
+	}
+	a.Ignore("sync")
+	a.Reset(6)
+	if len(got) != 2 {
+		t.Fatalf("ignored watcher was called, got %v", got)
+	}
+}
+
+func TestOfWatchSync(t *testing.T) {
+	a := NewOf(0)
+	var got int
+	a.WatchSync("sync", func(key interface{}, a *Of[int], old, new int) {
+		got = new
+	})
+	a.Reset(3)
+	if got != 3 {
+		t.Fatalf("got %v, wanted %v", got, 3)
+	}
+}
+
+func TestWatcherErrors(t *testing.T) {
+	type failure struct {
+		key interface{}
+		err error
+	}
+	failures := make(chan failure, 10)
+	a := New(0, WatcherErrorHandler(func(key, ref interface{}, err error) {
+		failures <- failure{key, err}
+	}))
+	errOdd := errors.New("odd")
+	a.Watch("panics", func(key string, a *Atom, old, new int) {
+		panic("boom")
+	})
+	a.Watch("returns", func(key string, a *Atom, old, new int) error {
+		if new%2 != 0 {
+			return errOdd
+		}
+		return nil
+	})
+	a.Reset(1)
+	got := map[interface{}]error{}
+	for i := 0; i < 2; i++ {
+		f := <-failures
+		got[f.key] = f.err
+	}
+	if !errors.Is(got["panics"], etm.ErrWatcherPanicked) {
+		t.Fatalf("got %v, wanted %v", got["panics"], etm.ErrWatcherPanicked)
+	}
+	if got["returns"] != errOdd {
+		t.Fatalf("got %v, wanted %v", got["returns"], errOdd)
+	}
+}
+
+func TestMaxWatcherFailures(t *testing.T) {
+	a := New(0,
+		WatcherExecutor(executor.Synchronous),
+		MaxWatcherFailures(2))
+	calls := 0
+	a.Watch("foo", func(key string, a *Atom, old, new int) (int, error) {
+		calls++
+		if new < 10 {
+			return 0, errors.New("too small")
+		}
+		return new, nil
+	})
+	a.Reset(1)
+	a.Reset(10)
+	a.Reset(2)
+	a.Reset(3)
+	a.Reset(20)
+	// The failure count is reset by the success so the watcher is only
+	// removed by the third and fourth changes.
+	if calls != 4 {
+		t.Fatalf("got %v calls, wanted %v", calls, 4)
+	}
+}
+
+func TestWatchSyncPanic(t *testing.T) {
+	var handled error
+	a := New(0, WatcherErrorHandler(func(key, ref interface{}, err error) {
+		handled = err
+	}))
+	a.WatchSync("sync", func(key string, a *Atom, old, new int) {
+		panic(errors.New("boom"))
+	})
+	a.Reset(1)
+	if !errors.Is(handled, etm.ErrWatcherPanicked) {
+		t.Fatalf("got %v, wanted %v", handled, etm.ErrWatcherPanicked)
+	}
+	if a.Deref() != 1 {
+		t.Fatalf("got %v, wanted %v", a.Deref(), 1)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	a := New(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := a.Subscribe(ctx)
+	for i := 1; i <= 3; i++ {
+		a.Reset(i)
+	}
+	var seq uint64
+	for i := 1; i <= 3; i++ {
+		c := <-changes
+		if c.Old != i-1 || c.New != i {
+			t.Fatalf("got %v, wanted %v -> %v", c, i-1, i)
+		}
+		if c.Seq <= seq {
+			t.Fatalf("got sequence %v after %v", c.Seq, seq)
+		}
+		seq = c.Seq
+	}
+	cancel()
+	for range changes {
+	}
+	if n := a.of.watcherSet().Len(); n != 0 {
+		t.Fatalf("got %v watchers after cancel, wanted none", n)
+	}
+}
+
+func TestSubscribeConcurrent(t *testing.T) {
+	const goroutines, swaps = 4, 250
+	a := New(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := a.Subscribe(ctx)
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < swaps; j++ {
+				a.Swap(func(cur int) int { return cur + 1 })
+			}
+		}()
+	}
+	prev := Change{New: 0}
+	for i := 0; i < goroutines*swaps; i++ {
+		c := <-changes
+		if c.Old != prev.New || (i > 0 && c.Seq != prev.Seq+1) {
+			t.Fatalf("got %+v after %+v", c, prev)
+		}
+		prev = c
+	}
+	wg.Wait()
+}
+
+func TestSubscribeDrop(t *testing.T) {
+	a := New(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := a.Subscribe(ctx,
+		SubscribeBuffer(1),
+		SubscribeOverflow(Drop))
+	a.Reset(1)
+	// The first change is waiting to be received so the rest are
+	// dropped.
+	for i := 2; i <= 5; i++ {
+		a.Reset(i)
+	}
+	first := <-changes
+	if first.New != 1 {
+		t.Fatalf("got %v, wanted %v", first.New, 1)
+	}
+	for i := 6; i < 1000; i++ {
+		a.Reset(i)
+		select {
+		case c := <-changes:
+			if c.Seq <= first.Seq+1 {
+				t.Fatalf("got sequence %v, wanted a gap after %v", c.Seq, first.Seq)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("subscriber never saw another change")
+}
+
+func TestWatchSelect(t *testing.T) {
+	a := New(hashmap.New("a", 1, "b", 1),
+		WatcherExecutor(executor.Synchronous))
+	var got [][2]interface{}
+	a.WatchSelect("foo",
+		func(m *hashmap.Map) interface{} { return m.At("a") },
+		func(key string, a *Atom, old, new interface{}) {
+			got = append(got, [2]interface{}{old, new})
+		})
+	a.Swap(func(m *hashmap.Map) *hashmap.Map { return m.Assoc("b", 2) })
+	a.Swap(func(m *hashmap.Map) *hashmap.Map { return m.Assoc("a", 2) })
+	if len(got) != 1 || got[0] != [2]interface{}{1, 2} {
+		t.Fatalf("got %v, wanted %v", got, [][2]interface{}{{1, 2}})
+	}
+}
+
+func TestWatchPath(t *testing.T) {
+	a := New(hashmap.New("users", hashmap.New("bob", 1)),
+		WatcherExecutor(executor.Synchronous))
+	var got []interface{}
+	a.WatchPath("foo", []interface{}{"users", "alice"},
+		func(key string, a *Atom, old, new interface{}) {
+			got = append(got, new)
+		})
+	setUser := func(name string, v int) {
+		a.Swap(func(m *hashmap.Map) *hashmap.Map {
+			users := m.At("users").(*hashmap.Map)
+			return m.Assoc("users", users.Assoc(name, v))
+		})
+	}
+	setUser("bob", 2)
+	setUser("alice", 1)
+	setUser("bob", 3)
+	setUser("alice", 2)
+	a.Reset(hashmap.New("users", 5))
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != nil {
+		t.Fatalf("got %v, wanted %v", got, []interface{}{1, 2, nil})
+	}
+}
@@ -0,0 +1,416 @@
+package atom
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"jsouthworth.net/go/dyn"
+	"jsouthworth.net/go/etm/executor"
+	"jsouthworth.net/go/etm/internal/genfn"
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+// Of is an atom managing a value of type T. It has the same semantics
+// as Atom but the value is stored without boxing it in an interface and
+// update functions are called directly instead of through reflection.
+type Of[T any] struct {
+	state     atomic.Pointer[version[T]]
+	validator atomic.Pointer[func(T) error]
+	watchers  *watchers.Watchers
+	equal     func(interface{}, interface{}) bool
+
+	maxRetries int
+	backoff    func(attempt int) time.Duration
+
+	// ref is the reference handed to untyped watchers, it is the
+	// Atom when this is the state of an untyped atom.
+	ref interface{}
+	// view is the untyped view of the atom returned by Atom.
+	view atomic.Pointer[Atom]
+}
+
+// version is a value of an atom along with the sequence number of the
+// change that made it. Only changes that are notified to watchers are
+// numbered.
+type version[T any] struct {
+	val T
+	seq uint64
+}
+
+// NewOf returns a new atom with an initial value of s. NewOf panics if
+// a Validator is supplied that rejects s.
+func NewOf[T any](s T, options ...Option) *Of[T] {
+	a := &Of[T]{}
+	a.init(a, s, options)
+	return a
+}
+
+func (a *Of[T]) init(ref interface{}, s T, options []Option) {
+	var opts atomOptions
+
+	//Default to dyn's equal function
+	EqualityFunc(dyn.Equal)(&opts)
+	WatcherExecutor(executor.Default)(&opts)
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	a.state.Store(&version[T]{val: s})
+	if opts.validator != nil {
+		fn := opts.validator
+		if err := a.SetValidator(func(v T) error { return fn(v) }); err != nil {
+			panic(err)
+		}
+	}
+	a.watchers = watchers.NewWithConfig(opts.equalityFn, watchers.Config{
+		Executor: opts.exec,
+		Buffer:   opts.watcherBuffer,
+		Overflow: watchers.Overflow(opts.watcherOverflow),
+
+		ErrorHandler: opts.watcherErrorFn,
+		MaxFailures:  opts.watcherMaxFails,
+	})
+	a.equal = opts.equalityFn
+	a.maxRetries = opts.maxRetries
+	a.backoff = opts.backoff
+	a.ref = ref
+}
+
+// Atom returns an untyped view of the atom. The view shares the value,
+// validator and watchers of a, it may be used wherever an *Atom is
+// expected as long as the values passed to it are of type T. Values of
+// other types make the view panic.
+func (a *Of[T]) Atom() *Atom {
+	if v := a.view.Load(); v != nil {
+		return v
+	}
+	a.view.CompareAndSwap(nil, &Atom{of: a})
+	return a.view.Load()
+}
+
+// Deref returns the current value of the atom.
+func (a *Of[T]) Deref() T {
+	return a.state.Load().val
+}
+
+// Swap updates the atom synchronously. The atom's value will be updated
+// to the result of applying fn to the current value when Swap returns.
+// fn may be called more than once when there is contention on the atom.
+// Swap panics with an error wrapping ErrInvalidState if the validator
+// rejects the new value.
+func (a *Of[T]) Swap(fn func(old T) T) T {
+	_, new := a.SwapVals(fn)
+	return new
+}
+
+// SwapVals is like Swap but returns both the value that was replaced
+// and the new value.
+func (a *Of[T]) SwapVals(fn func(old T) T) (T, T) {
+	for {
+		old := a.state.Load()
+		new := fn(old.val)
+		if err := a.validate(new); err != nil {
+			panic(err)
+		}
+		if a.commit(old, new) {
+			return old.val, new
+		}
+	}
+}
+
+// TrySwap is like Swap but fn may fail. If fn returns an error the atom
+// is left unchanged, watchers are not notified and TrySwap returns the
+// value fn was applied to along with the error. An error wrapping
+// ErrInvalidState is returned in the same way if the validator rejects
+// the new value.
+func (a *Of[T]) TrySwap(fn func(old T) (T, error)) (T, error) {
+	for {
+		old := a.state.Load()
+		new, err := fn(old.val)
+		if err == nil {
+			err = a.validate(new)
+		}
+		if err != nil {
+			return old.val, err
+		}
+		if a.commit(old, new) {
+			return new, nil
+		}
+	}
+}
+
+// SwapContext is like TrySwap but gives up when ctx is done, returning
+// ctx.Err(), or when the atom's MaxRetries limit is reached, returning
+// a *RetryError. Between failed attempts SwapContext waits as directed
+// by the atom's Backoff.
+func (a *Of[T]) SwapContext(ctx context.Context, fn func(old T) (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		old := a.state.Load()
+		if err := ctx.Err(); err != nil {
+			return old.val, err
+		}
+		new, err := fn(old.val)
+		if err == nil {
+			err = a.validate(new)
+		}
+		if err != nil {
+			return old.val, err
+		}
+		if a.commit(old, new) {
+			return new, nil
+		}
+		if a.maxRetries > 0 && attempt > a.maxRetries {
+			return a.Deref(), &RetryError{Attempts: attempt}
+		}
+		if err := a.wait(ctx, attempt); err != nil {
+			return a.Deref(), err
+		}
+	}
+}
+
+func (a *Of[T]) wait(ctx context.Context, attempt int) error {
+	if a.backoff == nil {
+		return nil
+	}
+	d := a.backoff(attempt)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reset forcibly updates the value of the atom to new. Reset panics
+// with an error wrapping ErrInvalidState if the validator rejects new.
+func (a *Of[T]) Reset(new T) T {
+	_, new = a.ResetVals(new)
+	return new
+}
+
+// ResetVals is like Reset but returns both the value that was replaced
+// and the new value.
+func (a *Of[T]) ResetVals(new T) (T, T) {
+	old, new, err := a.tryResetVals(new)
+	if err != nil {
+		panic(err)
+	}
+	return old, new
+}
+
+// TryReset is like Reset but returns an error wrapping ErrInvalidState
+// instead of panicking if the validator rejects new. On error the atom
+// is left unchanged and its current value is returned.
+func (a *Of[T]) TryReset(new T) (T, error) {
+	_, new, err := a.tryResetVals(new)
+	return new, err
+}
+
+// tryResetVals returns the current value twice along with the error
+// when the validator rejects new.
+func (a *Of[T]) tryResetVals(new T) (T, T, error) {
+	if err := a.validate(new); err != nil {
+		cur := a.Deref()
+		return cur, cur, err
+	}
+	for {
+		old := a.state.Load()
+		if a.commit(old, new) {
+			return old.val, new, nil
+		}
+	}
+}
+
+// CompareAndSet sets the value of the atom to new only if the current
+// value is equal to expected according to the atom's equality function.
+// It reports whether the value was set. CompareAndSet panics with an
+// error wrapping ErrInvalidState if the validator rejects new.
+func (a *Of[T]) CompareAndSet(expected, new T) bool {
+	set, err := a.TryCompareAndSet(expected, new)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// TryCompareAndSet is like CompareAndSet but returns an error wrapping
+// ErrInvalidState instead of panicking if the validator rejects new.
+func (a *Of[T]) TryCompareAndSet(expected, new T) (bool, error) {
+	if err := a.validate(new); err != nil {
+		return false, err
+	}
+	for {
+		old := a.state.Load()
+		if !a.equal(old.val, expected) {
+			return false, nil
+		}
+		if a.commit(old, new) {
+			return true, nil
+		}
+	}
+}
+
+// SetValidator sets the function used to validate every new value of
+// the atom. The current value is validated first and if it is rejected
+// the validator is not set and the error is returned. Passing nil
+// removes the validator.
+func (a *Of[T]) SetValidator(fn func(T) error) error {
+	if fn == nil {
+		a.validator.Store(nil)
+		return nil
+	}
+	if err := fn(a.Deref()); err != nil {
+		return invalidState(err)
+	}
+	a.validator.Store(&fn)
+	return nil
+}
+
+// Watch adds function to be called when the value of the atom changes.
+// Watchers follow the same rules as those added with Atom.Watch.
+func (a *Of[T]) Watch(key interface{}, fn func(key interface{}, a *Of[T], old, new T)) *Of[T] {
+	watcher := &watchers.Watcher{
+		Fn: func(args ...interface{}) interface{} {
+			fn(args[0], a, genfn.Cast[T](args[2]), genfn.Cast[T](args[3]))
+			return nil
+		},
+	}
+	a.watchers.Add(key, watcher)
+	return a
+}
+
+// WatchSync adds a function to be called synchronously when the value
+// of the atom changes. It follows the same rules as Atom.WatchSync.
+func (a *Of[T]) WatchSync(key interface{}, fn func(key interface{}, a *Of[T], old, new T)) *Of[T] {
+	watcher := &watchers.Watcher{
+		Fn: func(args ...interface{}) interface{} {
+			fn(args[0], a, genfn.Cast[T](args[2]), genfn.Cast[T](args[3]))
+			return nil
+		},
+		Sync: true,
+	}
+	a.watchers.Add(key, watcher)
+	return a
+}
+
+// Ignore removes the watcher with the passed in key. It follows the same
+// rules as Atom.Ignore.
+func (a *Of[T]) Ignore(key interface{}) *Of[T] {
+	a.watchers.Delete(key)
+	return a
+}
+
+func (a *Of[T]) validate(val T) error {
+	fn := a.validator.Load()
+	if fn == nil {
+		return nil
+	}
+	if err := (*fn)(val); err != nil {
+		return invalidState(err)
+	}
+	return nil
+}
+
+func invalidState(err error) error {
+	return fmt.Errorf("%w: %w", ErrInvalidState, err)
+}
+
+// commit replaces old with new, reporting whether it did so. Changes
+// the watchers must be notified of are numbered as they are committed
+// so that the watchers see them in the order they were made.
+func (a *Of[T]) commit(old *version[T], new T) bool {
+	next := &version[T]{val: new, seq: old.seq}
+	// Avoid boxing the values when nobody is watching.
+	notify := a.watchers.Len() > 0 && !a.equal(old.val, new)
+	if notify {
+		next.seq++
+	}
+	if !a.state.CompareAndSwap(old, next) {
+		return false
+	}
+	if notify {
+		a.watchers.Notify(next.seq, a.ref, old.val, new)
+	}
+	return true
+}
+
+// untyped is implemented by every Of. It lets Atom work with the value
+// of an atom of any type as an interface{}.
+type untyped interface {
+	derefAny() interface{}
+	swapAny(fn func(old interface{}) interface{}) (interface{}, interface{})
+	trySwapAny(ctx context.Context, fn func(old interface{}) (interface{}, error)) (interface{}, error)
+	resetAny(new interface{}) (interface{}, interface{}, error)
+	compareAndSetAny(expected, new interface{}) (bool, error)
+	setValidatorAny(fn func(interface{}) error) error
+	watcherSet() *watchers.Watchers
+	equality() func(interface{}, interface{}) bool
+}
+
+// The functions passed by Atom are used as they are when T is
+// interface{}, otherwise they are adapted to T.
+
+func (a *Of[T]) derefAny() interface{} {
+	return a.Deref()
+}
+
+func (a *Of[T]) swapAny(fn func(old interface{}) interface{}) (interface{}, interface{}) {
+	if f, ok := interface{}(fn).(func(T) T); ok {
+		return a.SwapVals(f)
+	}
+	return a.SwapVals(func(old T) T {
+		return genfn.Cast[T](fn(old))
+	})
+}
+
+// trySwapAny is SwapContext or, when ctx is nil, TrySwap.
+func (a *Of[T]) trySwapAny(ctx context.Context, fn func(old interface{}) (interface{}, error)) (interface{}, error) {
+	f, ok := interface{}(fn).(func(T) (T, error))
+	if !ok {
+		f = func(old T) (T, error) {
+			new, err := fn(old)
+			if err != nil {
+				return old, err
+			}
+			return genfn.Cast[T](new), nil
+		}
+	}
+	if ctx == nil {
+		return a.TrySwap(f)
+	}
+	return a.SwapContext(ctx, f)
+}
+
+func (a *Of[T]) resetAny(new interface{}) (interface{}, interface{}, error) {
+	return a.tryResetVals(genfn.Cast[T](new))
+}
+
+func (a *Of[T]) compareAndSetAny(expected, new interface{}) (bool, error) {
+	return a.TryCompareAndSet(genfn.Cast[T](expected), genfn.Cast[T](new))
+}
+
+func (a *Of[T]) setValidatorAny(fn func(interface{}) error) error {
+	if fn == nil {
+		return a.SetValidator(nil)
+	}
+	if f, ok := interface{}(fn).(func(T) error); ok {
+		return a.SetValidator(f)
+	}
+	return a.SetValidator(func(v T) error { return fn(v) })
+}
+
+func (a *Of[T]) watcherSet() *watchers.Watchers {
+	return a.watchers
+}
+
+func (a *Of[T]) equality() func(interface{}, interface{}) bool {
+	return a.equal
+}
@@ -0,0 +1,76 @@
+package atom
+
+import (
+	"jsouthworth.net/go/etm/internal/genfn"
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+// WatchSelect adds a function to be called when the part of the atom's
+// value picked out by selector changes. selector is a function of the
+// form func(v vT) sT, it is applied to the old and new values of every
+// change and the watcher is only called when the results differ under
+// the atom's equality function. The watcher is passed the selected
+// parts instead of the whole values, otherwise it follows the same
+// rules as those added with Watch and shares their keys.
+//
+// Passing a func(...interface{})interface{} as selector or fn avoids
+// reflect based function application allow faster execution at the
+// expense of some clarity.
+func (a *Atom) WatchSelect(key interface{}, selector interface{}, fn interface{}, args ...interface{}) *Atom {
+	sel := genfn.MakeGeneric(selector)
+	watcher := &watchers.Watcher{
+		Fn:   selectFn(sel, a.of.equality(), watchers.Fn(fn)),
+		Args: args,
+		Ref:  a,
+	}
+	a.of.watcherSet().Add(key, watcher)
+	return a
+}
+
+// WatchPath is like WatchSelect but selects the part of the value found
+// by following path. Each element of the path is looked up with the At
+// method of the value found so far, as implemented by the immutable
+// collections. A path that leads through a value without an At method
+// selects nil.
+func (a *Atom) WatchPath(key interface{}, path []interface{}, fn interface{}, args ...interface{}) *Atom {
+	return a.WatchSelect(key, PathSelector(path...), fn, args...)
+}
+
+// PathSelector returns a selector, suitable for WatchSelect, that
+// follows path as described by WatchPath.
+func PathSelector(path ...interface{}) func(...interface{}) interface{} {
+	return func(args ...interface{}) interface{} {
+		v := args[0]
+		for _, k := range path {
+			a, ok := v.(associative)
+			if !ok {
+				return nil
+			}
+			v = a.At(k)
+		}
+		return v
+	}
+}
+
+type associative interface {
+	At(key interface{}) interface{}
+}
+
+// selectFn returns a watcher function that calls fn with the selected
+// parts of the old and new values when they differ.
+func selectFn(
+	sel func(...interface{}) interface{},
+	equal func(interface{}, interface{}) bool,
+	fn func(...interface{}) interface{},
+) func(...interface{}) interface{} {
+	return func(args ...interface{}) interface{} {
+		old, new := sel(args[2]), sel(args[3])
+		if equal(old, new) {
+			return nil
+		}
+		fnargs := make([]interface{}, len(args))
+		copy(fnargs, args)
+		fnargs[2], fnargs[3] = old, new
+		return fn(fnargs...)
+	}
+}
@@ -0,0 +1,97 @@
+package atom
+
+import (
+	"context"
+	"sync"
+
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+// Change is a change to the value of a reference delivered to a
+// subscriber.
+type Change struct {
+	Old, New interface{}
+	// Seq is the number given to the change when it was committed,
+	// it increases by one for each change to the reference's value.
+	// Changes are sent in Seq order, so a gap means the subscriber's
+	// overflow policy dropped or coalesced the changes in between.
+	Seq uint64
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	buffer   int
+	overflow Overflow
+}
+
+// SubscribeBuffer limits the number of changes waiting for the
+// subscriber to n, counting the one being sent on the channel. The
+// default is an unlimited buffer, which never holds up updates and
+// never loses changes but grows for as long as the subscriber falls
+// behind.
+func SubscribeBuffer(n int) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		opts.buffer = n
+	}
+}
+
+// SubscribeOverflow sets what happens to changes when the subscriber's
+// buffer is full. The default is Block.
+func SubscribeOverflow(policy Overflow) SubscribeOption {
+	return func(opts *subscribeOptions) {
+		opts.overflow = policy
+	}
+}
+
+// Subscribe returns a channel on which the changes to the atom are sent
+// in the order they were made until ctx is done. The subscription is
+// then removed and the channel closed. Subscribers are watchers and
+// follow the same rules, see Watch.
+func (a *Atom) Subscribe(ctx context.Context, options ...SubscribeOption) <-chan Change {
+	return subscribe(ctx, a.of.watcherSet(), options)
+}
+
+type subscription struct {
+	ctx    context.Context
+	ch     chan Change
+	mu     sync.Mutex
+	closed bool
+}
+
+func subscribe(ctx context.Context, w *watchers.Watchers, options []SubscribeOption) <-chan Change {
+	var opts subscribeOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	s := &subscription{ctx: ctx, ch: make(chan Change)}
+	w.Add(s, &watchers.Watcher{
+		OnChange: s.send,
+		Buffer:   opts.buffer,
+		Overflow: watchers.Overflow(opts.overflow),
+	})
+	context.AfterFunc(ctx, func() {
+		w.Delete(s)
+		// A send in progress gives up once ctx is done so this
+		// doesn't wait for the subscriber.
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+	return s.ch
+}
+
+func (s *subscription) send(seq uint64, old, new interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	select {
+	case s.ch <- Change{Old: old, New: new, Seq: seq}:
+	case <-s.ctx.Done():
+	}
+	return nil
+}
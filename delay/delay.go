@@ -0,0 +1,83 @@
+// Package delay implements a lazily computed reference. The computation
+// of a delay is run the first time it is dereferenced and its result is
+// cached so the computation runs at most once no matter how many
+// goroutines dereference the delay concurrently.
+package delay
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"jsouthworth.net/go/etm/internal/genfn"
+)
+
+// Delay is a reference whose value is computed on first access.
+type Delay struct {
+	once     sync.Once
+	realized int32
+
+	fn   func(...interface{}) (interface{}, error)
+	args []interface{}
+
+	val      interface{}
+	err      error
+	panicked bool
+	panicVal interface{}
+}
+
+// New returns a delay that will compute its value by applying fn to
+// args. New takes a function of the form func(args...) rT or
+// func(args...) (rT, error).
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func New(fn interface{}, args ...interface{}) *Delay {
+	return &Delay{
+		fn:   genfn.MakeGenericE(fn),
+		args: args,
+	}
+}
+
+// Deref computes the value of the delay if it has not already been
+// computed and returns it. If the computation panicked Deref panics
+// with the same value, on this and every subsequent call. If the
+// computation returned an error Deref panics with that error, use Force
+// to receive it as an error instead.
+func (d *Delay) Deref() interface{} {
+	val, err := d.Force()
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// Force computes the value of the delay if it has not already been
+// computed and returns it along with the error returned by the
+// computation. If the computation panicked Force panics with the same
+// value, on this and every subsequent call.
+func (d *Delay) Force() (interface{}, error) {
+	d.once.Do(d.compute)
+	if d.panicked {
+		panic(d.panicVal)
+	}
+	return d.val, d.err
+}
+
+// Realized reports whether the value of the delay has been computed.
+func (d *Delay) Realized() bool {
+	return atomic.LoadInt32(&d.realized) != 0
+}
+
+func (d *Delay) compute() {
+	defer func() {
+		if v := recover(); v != nil {
+			d.panicked = true
+			d.panicVal = v
+		}
+		// Release the computation so it can be garbage collected.
+		d.fn, d.args = nil, nil
+		atomic.StoreInt32(&d.realized, 1)
+	}()
+	d.val, d.err = d.fn(d.args...)
+}
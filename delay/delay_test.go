@@ -0,0 +1,87 @@
+package delay
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"jsouthworth.net/go/etm"
+)
+
+func TestDeref(t *testing.T) {
+	var calls int32
+	d := New(func(a, b int) int {
+		atomic.AddInt32(&calls, 1)
+		return a + b
+	}, 1, 2)
+	if d.Realized() {
+		t.Fatal("delay realized before deref")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			if got := d.Deref(); got != 3 {
+				t.Errorf("got %v, wanted %v\n", got, 3)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if !d.Realized() {
+		t.Fatal("delay not realized after deref")
+	}
+	if calls != 1 {
+		t.Fatalf("computation ran %v times, wanted once", calls)
+	}
+}
+
+func TestForceError(t *testing.T) {
+	errBoom := errors.New("boom")
+	calls := 0
+	d := New(func() (int, error) {
+		calls++
+		return 0, errBoom
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := d.Force(); err != errBoom {
+			t.Fatalf("got %v, wanted %v\n", err, errBoom)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("computation ran %v times, wanted once", calls)
+	}
+	defer func() {
+		if err := recover(); err != errBoom {
+			t.Fatalf("got %v, wanted %v\n", err, errBoom)
+		}
+	}()
+	d.Deref()
+}
+
+func TestDerefPanics(t *testing.T) {
+	calls := 0
+	d := New(func(args ...interface{}) interface{} {
+		calls++
+		panic("boom")
+	})
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if v := recover(); v != "boom" {
+					t.Fatalf("got %v, wanted %v\n", v, "boom")
+				}
+			}()
+			d.Deref()
+		}()
+	}
+	if calls != 1 {
+		t.Fatalf("computation ran %v times, wanted once", calls)
+	}
+	if !d.Realized() {
+		t.Fatal("delay not realized after a failed computation")
+	}
+}
+
+var _ etm.Deref = (*Delay)(nil)
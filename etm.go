@@ -0,0 +1,72 @@
+// Package etm defines the interfaces shared by the reference types in
+// this library. The reference types themselves live in the sub
+// packages: atom, agent and ref manage changing state, future, promise
+// and delay hold a value that is produced once, and vars holds values
+// bound for the extent of a context. Code that only needs a common
+// capability, such as dereferencing or watching, can be written once
+// against these interfaces.
+package etm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidState is wrapped by the error reported when a validator
+// rejects a new value of a reference.
+var ErrInvalidState = errors.New("etm: invalid reference state")
+
+// ErrWatcherPanicked is wrapped by the error reported when a watcher
+// panics.
+var ErrWatcherPanicked = errors.New("etm: watcher panicked")
+
+// Deref is implemented by every reference type. Deref returns the
+// current value of the reference.
+type Deref interface {
+	Deref() interface{}
+}
+
+// BlockingDeref is implemented by references whose value may not be
+// available yet, such as futures and promises. Deref blocks until the
+// value is available.
+type BlockingDeref interface {
+	Deref
+	// DerefTimeout is like Deref but returns fallback if the value is
+	// not available within timeout.
+	DerefTimeout(timeout time.Duration, fallback interface{}) interface{}
+	// DerefContext is like Deref but returns ctx.Err() if ctx is done
+	// before the value is available.
+	DerefContext(ctx context.Context) (interface{}, error)
+	// Realized reports whether the value is available.
+	Realized() bool
+}
+
+// Watchable is implemented by references that notify watchers of
+// changes. AddWatch and RemoveWatch are the Watch and Ignore methods of
+// the reference without the chaining result, so references of
+// different types can be watched through the same interface:
+//
+//	for _, r := range []etm.Watchable{atm, agt, ref} {
+//		r.AddWatch("log", logChange)
+//	}
+type Watchable interface {
+	Deref
+	AddWatch(key interface{}, fn interface{}, args ...interface{})
+	RemoveWatch(key interface{})
+}
+
+// Validatable is implemented by references that validate their new
+// values. The validator returns a non-nil error to reject a value.
+type Validatable interface {
+	SetValidator(fn func(interface{}) error) error
+}
+
+// MetaHolder is implemented by references that carry metadata. The
+// metadata is not part of the value of the reference and changing it
+// does not notify watchers.
+type MetaHolder interface {
+	Meta() interface{}
+	ResetMeta(m interface{}) interface{}
+	AlterMeta(fn interface{}, args ...interface{}) interface{}
+}
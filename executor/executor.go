@@ -0,0 +1,145 @@
+// Package executor implements the ways the rest of etm runs work
+// asynchronously. Agents run their actions and atoms, agents and refs
+// notify their watchers through an Executor. The implementations here
+// cover the common cases and any type with an Execute method may be
+// supplied instead, for instance to instrument a pool or to make tests
+// deterministic.
+package executor
+
+import (
+	"sync"
+	"time"
+)
+
+// Executor runs functions. Execute must eventually run fn exactly once.
+// It may run fn before returning, on another goroutine, or later.
+type Executor interface {
+	Execute(fn func())
+}
+
+// Func adapts an ordinary function to the Executor interface.
+type Func func(fn func())
+
+// Execute calls f(fn).
+func (f Func) Execute(fn func()) {
+	f(fn)
+}
+
+// Default runs every function on a new goroutine.
+var Default Executor = goExecutor{}
+
+type goExecutor struct{}
+
+func (goExecutor) Execute(fn func()) {
+	go fn()
+}
+
+// Synchronous runs every function on the calling goroutine before
+// Execute returns. It is mostly useful in tests where it makes agent
+// actions and watcher notifications happen in a deterministic order.
+var Synchronous Executor = syncExecutor{}
+
+type syncExecutor struct{}
+
+func (syncExecutor) Execute(fn func()) {
+	fn()
+}
+
+// Bounded runs functions on at most n goroutines. Functions submitted
+// while all of the goroutines are busy are queued and run in the order
+// they were submitted. The goroutines are started as they are needed.
+type Bounded struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []func()
+	workers int
+	idle    int
+	max     int
+}
+
+// NewBounded returns an executor that runs functions on at most n
+// goroutines. NewBounded panics if n is less than 1.
+func NewBounded(n int) *Bounded {
+	if n < 1 {
+		panic("executor: bounded executor needs at least one goroutine")
+	}
+	p := &Bounded{max: n}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Execute queues fn to be run by one of the executor's goroutines.
+func (p *Bounded) Execute(fn func()) {
+	p.mu.Lock()
+	p.tasks = append(p.tasks, fn)
+	switch {
+	case p.idle > 0:
+		p.idle--
+		p.cond.Signal()
+	case p.workers < p.max:
+		p.workers++
+		go p.work()
+	}
+	p.mu.Unlock()
+}
+
+func (p *Bounded) work() {
+	p.mu.Lock()
+	for {
+		for len(p.tasks) == 0 {
+			p.idle++
+			p.cond.Wait()
+		}
+		fn := p.tasks[0]
+		p.tasks[0] = nil
+		p.tasks = p.tasks[1:]
+		p.mu.Unlock()
+		fn()
+		p.mu.Lock()
+	}
+}
+
+// Cached runs functions on a pool of goroutines that grows as needed.
+// A function is handed to an idle goroutine if there is one, otherwise
+// a new goroutine is started. Goroutines exit after being idle for the
+// idle timeout.
+type Cached struct {
+	work        chan func()
+	idleTimeout time.Duration
+}
+
+// NewCached returns an executor whose goroutines exit after being idle
+// for idleTimeout.
+func NewCached(idleTimeout time.Duration) *Cached {
+	return &Cached{
+		work:        make(chan func()),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Execute hands fn to an idle goroutine or starts a new one.
+func (p *Cached) Execute(fn func()) {
+	select {
+	case p.work <- fn:
+	default:
+		go p.worker(fn)
+	}
+}
+
+func (p *Cached) worker(fn func()) {
+	for fn != nil {
+		fn()
+		fn = p.next()
+	}
+}
+
+func (p *Cached) next() func() {
+	timer := time.NewTimer(p.idleTimeout)
+	defer timer.Stop()
+	select {
+	case fn := <-p.work:
+		return fn
+	case <-timer.C:
+		return nil
+	}
+}
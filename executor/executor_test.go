@@ -0,0 +1,120 @@
+package executor
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSynchronous(t *testing.T) {
+	ran := false
+	Synchronous.Execute(func() { ran = true })
+	if !ran {
+		t.Fatal("function was not run before Execute returned")
+	}
+}
+
+func TestFunc(t *testing.T) {
+	var calls int
+	exec := Func(func(fn func()) {
+		calls++
+		fn()
+	})
+	ran := false
+	exec.Execute(func() { ran = true })
+	if !ran || calls != 1 {
+		t.Fatalf("got ran=%v calls=%v, wanted ran=true calls=1", ran, calls)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	done := make(chan struct{})
+	Default.Execute(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("function was not run")
+	}
+}
+
+func TestBounded(t *testing.T) {
+	const (
+		n     = 3
+		tasks = 50
+	)
+	exec := NewBounded(n)
+	var running, peak int32
+	var wg sync.WaitGroup
+	wg.Add(tasks)
+	for i := 0; i < tasks; i++ {
+		exec.Execute(func() {
+			defer wg.Done()
+			cur := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if cur <= old ||
+					atomic.CompareAndSwapInt32(&peak, old, cur) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	if peak > n {
+		t.Fatalf("%v functions ran at once, wanted at most %v", peak, n)
+	}
+}
+
+func TestBoundedOrder(t *testing.T) {
+	exec := NewBounded(1)
+	var got []int
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		i := i
+		exec.Execute(func() {
+			got = append(got, i)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("functions ran out of order: %v", got)
+		}
+	}
+}
+
+func TestBoundedInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected NewBounded(0) to panic")
+		}
+	}()
+	NewBounded(0)
+}
+
+func TestCached(t *testing.T) {
+	const tasks = 20
+	exec := NewCached(10 * time.Millisecond)
+	var started sync.WaitGroup
+	started.Add(tasks)
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(tasks)
+	for i := 0; i < tasks; i++ {
+		exec.Execute(func() {
+			started.Done()
+			<-release
+			done.Done()
+		})
+	}
+	// Every function blocks until all have started, so this only
+	// completes if the pool grew to run them all at once.
+	started.Wait()
+	close(release)
+	done.Wait()
+}
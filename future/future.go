@@ -0,0 +1,168 @@
+// Package future implements a mechanism to run a computation
+// asynchronously and retrieve its result later. The computation is
+// started on its own goroutine as soon as the future is created and
+// dereferencing the future blocks until the computation has finished.
+// Once finished the result is cached so all further dereferences return
+// immediately.
+package future
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"jsouthworth.net/go/dyn"
+	"jsouthworth.net/go/etm/internal/genfn"
+)
+
+// ErrCancelled is the error reported when dereferencing a future that
+// was cancelled before its computation finished.
+var ErrCancelled = errors.New("future: cancelled")
+
+// Future is a mechanism to retrieve the result of an asynchronous
+// computation.
+type Future struct {
+	done   chan struct{}
+	once   sync.Once
+	cancel context.CancelFunc
+
+	val interface{}
+	err error
+}
+
+// Go runs fn on a new goroutine and returns a future for its result. Go
+// takes a function of the form func(args...) rT or func(args...) (rT,
+// error). If the function returns an error or panics the future fails
+// with that error.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func Go(fn interface{}, args ...interface{}) *Future {
+	f := newFuture(func() {})
+	go f.run(genfn.MakeGenericE(fn), args)
+	return f
+}
+
+// GoContext is like Go but passes a context derived from ctx as the
+// first argument to fn. The context is cancelled when the future is
+// cancelled, allowing the computation to stop early.
+func GoContext(ctx context.Context, fn interface{}, args ...interface{}) *Future {
+	ctx, cancel := context.WithCancel(ctx)
+	f := newFuture(cancel)
+	go f.run(genfn.MakeGenericE(fn), dyn.PrependArg(ctx, args...))
+	return f
+}
+
+func newFuture(cancel context.CancelFunc) *Future {
+	return &Future{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+}
+
+func (f *Future) run(fn func(...interface{}) (interface{}, error), args []interface{}) {
+	defer f.cancel()
+	f.complete(call(fn, args))
+}
+
+func call(fn func(...interface{}) (interface{}, error), args []interface{}) (val interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(v)
+		}
+	}()
+	return fn(args...)
+}
+
+func (f *Future) complete(val interface{}, err error) bool {
+	completed := false
+	f.once.Do(func() {
+		f.val, f.err = val, err
+		close(f.done)
+		completed = true
+	})
+	return completed
+}
+
+// Deref blocks until the computation has finished and returns its
+// result. Deref panics with the error if the computation failed or
+// ErrCancelled if the future was cancelled.
+func (f *Future) Deref() interface{} {
+	<-f.done
+	return f.result()
+}
+
+// DerefTimeout is like Deref but returns fallback if the computation
+// has not finished within timeout.
+func (f *Future) DerefTimeout(timeout time.Duration, fallback interface{}) interface{} {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return f.result()
+	case <-timer.C:
+		return fallback
+	}
+}
+
+// DerefContext blocks until the computation has finished or ctx is done.
+// Unlike Deref it returns the error of a failed or cancelled future
+// instead of panicking, and ctx.Err() if ctx is done first.
+func (f *Future) DerefContext(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when the future is realized.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Realized reports whether the computation has finished or the future
+// has been cancelled.
+func (f *Future) Realized() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel cancels the future if its computation has not yet finished and
+// reports whether it did so. The goroutine running the computation is
+// not stopped but its result is discarded. Futures started with
+// GoContext also have their context cancelled.
+func (f *Future) Cancel() bool {
+	if !f.complete(nil, ErrCancelled) {
+		return false
+	}
+	f.cancel()
+	return true
+}
+
+// Cancelled reports whether the future was cancelled.
+func (f *Future) Cancelled() bool {
+	return f.Realized() && f.err == ErrCancelled
+}
+
+func (f *Future) result() interface{} {
+	if f.err != nil {
+		panic(f.err)
+	}
+	return f.val
+}
+
+func panicError(v interface{}) error {
+	if err, ok := v.(error); ok {
+		return fmt.Errorf("future: computation panicked: %w", err)
+	}
+	return fmt.Errorf("future: computation panicked: %v", v)
+}
@@ -0,0 +1,120 @@
+package future
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"jsouthworth.net/go/etm"
+)
+
+func TestDeref(t *testing.T) {
+	f := Go(func(a, b int) int {
+		return a + b
+	}, 1, 2)
+	if got := f.Deref(); got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	if !f.Realized() {
+		t.Fatal("future isn't realized after deref")
+	}
+	if got := f.Deref(); got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+}
+
+func TestDerefFast(t *testing.T) {
+	f := Go(func(args ...interface{}) interface{} {
+		return args[0].(string) + "bar"
+	}, "foo")
+	if got := f.Deref(); got != "foobar" {
+		t.Fatalf("got %v, wanted %v\n", got, "foobar")
+	}
+}
+
+func TestDerefTimeout(t *testing.T) {
+	release := make(chan struct{})
+	f := Go(func() int {
+		<-release
+		return 1
+	})
+	if got := f.DerefTimeout(time.Millisecond, -1); got != -1 {
+		t.Fatalf("got %v, wanted %v\n", got, -1)
+	}
+	if f.Realized() {
+		t.Fatal("future realized before its computation finished")
+	}
+	close(release)
+	<-f.Done()
+	if got := f.DerefTimeout(time.Millisecond, -1); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestDerefContext(t *testing.T) {
+	errBoom := errors.New("boom")
+	f := Go(func() (int, error) {
+		return 0, errBoom
+	})
+	if _, err := f.DerefContext(context.Background()); err != errBoom {
+		t.Fatalf("got %v, wanted %v\n", err, errBoom)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release := make(chan struct{})
+	defer close(release)
+	block := Go(func() int {
+		<-release
+		return 1
+	})
+	if _, err := block.DerefContext(ctx); err != context.Canceled {
+		t.Fatalf("got %v, wanted %v\n", err, context.Canceled)
+	}
+}
+
+func TestDerefPanics(t *testing.T) {
+	f := Go(func() int {
+		panic("boom")
+	})
+	if _, err := f.DerefContext(context.Background()); err == nil {
+		t.Fatal("expected panicking computation to fail")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected deref of a failed future to panic")
+		}
+	}()
+	f.Deref()
+}
+
+func TestCancel(t *testing.T) {
+	stopped := make(chan struct{})
+	f := GoContext(context.Background(), func(ctx context.Context) int {
+		<-ctx.Done()
+		close(stopped)
+		return 1
+	})
+	if !f.Cancel() {
+		t.Fatal("couldn't cancel a running future")
+	}
+	<-stopped
+	if !f.Cancelled() {
+		t.Fatal("future isn't cancelled")
+	}
+	if f.Cancel() {
+		t.Fatal("cancelled an already cancelled future")
+	}
+	if _, err := f.DerefContext(context.Background()); err != ErrCancelled {
+		t.Fatalf("got %v, wanted %v\n", err, ErrCancelled)
+	}
+
+	done := Go(func() int { return 1 })
+	done.Deref()
+	if done.Cancel() || done.Cancelled() {
+		t.Fatal("cancelled a finished future")
+	}
+}
+
+var _ etm.BlockingDeref = (*Future)(nil)
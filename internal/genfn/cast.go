@@ -0,0 +1,11 @@
+package genfn
+
+// Cast converts v to T. Unlike a type assertion a nil v results in the
+// zero value of T instead of a panic when T is an interface type.
+func Cast[T any](v interface{}) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return v.(T)
+}
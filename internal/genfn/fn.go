@@ -1,14 +1,84 @@
 package genfn
 
-import "jsouthworth.net/go/dyn"
+import (
+	"reflect"
 
+	"jsouthworth.net/go/dyn"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// MakeGeneric converts fn into a func(...interface{}) interface{}. If fn
+// returns a value and a trailing error the resulting function panics
+// with the error when it is non-nil.
 func MakeGeneric(fn interface{}) func(...interface{}) interface{} {
 	switch v := fn.(type) {
 	case func(...interface{}) interface{}:
 		return v
 	default:
+		if returnsError(fn) {
+			f := makeReflectE(fn)
+			return func(args ...interface{}) interface{} {
+				out, err := f(args...)
+				if err != nil {
+					panic(err)
+				}
+				return out
+			}
+		}
 		return func(args ...interface{}) interface{} {
 			return dyn.Apply(v, args...)
 		}
 	}
 }
+
+// MakeGenericE converts fn into a func(...interface{}) (interface{}, error).
+// fn may return a value and a trailing error, functions that only return
+// a value never fail.
+func MakeGenericE(fn interface{}) func(...interface{}) (interface{}, error) {
+	switch v := fn.(type) {
+	case func(...interface{}) (interface{}, error):
+		return v
+	case func(...interface{}) interface{}:
+		return func(args ...interface{}) (interface{}, error) {
+			return v(args...), nil
+		}
+	default:
+		if returnsError(fn) {
+			return makeReflectE(fn)
+		}
+		return func(args ...interface{}) (interface{}, error) {
+			return dyn.Apply(v, args...), nil
+		}
+	}
+}
+
+func returnsError(fn interface{}) bool {
+	t := reflect.TypeOf(fn)
+	return t != nil && t.Kind() == reflect.Func &&
+		t.NumOut() == 2 && t.Out(1) == errorType
+}
+
+func makeReflectE(fn interface{}) func(...interface{}) (interface{}, error) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	return func(args ...interface{}) (interface{}, error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			in[i] = argValue(ft, i, arg)
+		}
+		out := fv.Call(in)
+		err, _ := out[1].Interface().(error)
+		return out[0].Interface(), err
+	}
+}
+
+func argValue(ft reflect.Type, i int, arg interface{}) reflect.Value {
+	if arg != nil {
+		return reflect.ValueOf(arg)
+	}
+	if ft.IsVariadic() && i >= ft.NumIn()-1 {
+		return reflect.Zero(ft.In(ft.NumIn() - 1).Elem())
+	}
+	return reflect.Zero(ft.In(i))
+}
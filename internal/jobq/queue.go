@@ -3,9 +3,14 @@ package jobq
 import (
 	"sync/atomic"
 
+	"jsouthworth.net/go/etm/executor"
 	"jsouthworth.net/go/etm/internal/mpscq"
 )
 
+// batchSize is the number of values processed before the queue yields
+// its executor so that queues sharing a bounded executor make progress.
+const batchSize = 64
+
 type atomicBool struct {
 	state int32
 }
@@ -47,13 +52,27 @@ type Queue struct {
 	running   *atomicBool
 	q         *mpscq.Queue
 	processFn func(interface{})
+	exec      executor.Executor
+}
+
+// Routed is implemented by values that must be processed by a specific
+// executor rather than the queue's default one. A nil executor selects
+// the queue's default. Routed executors are compared with == so they
+// must be comparable.
+type Routed interface {
+	Executor() executor.Executor
 }
 
 func New(process func(interface{})) *Queue {
+	return NewWithExecutor(process, executor.Default)
+}
+
+func NewWithExecutor(process func(interface{}), exec executor.Executor) *Queue {
 	return &Queue{
 		running:   newAtomicBool(false),
 		q:         mpscq.New(),
 		processFn: process,
+		exec:      exec,
 	}
 }
 
@@ -61,16 +80,62 @@ func (q *Queue) Enqueue(value interface{}) *Queue {
 	q.q.Push(value)
 	isRunning := q.running.Get()
 	if !isRunning && q.running.CAS(isRunning, true) {
-		go q.process()
+		q.schedule()
 	}
 	return q
 }
 
-func (q *Queue) process() {
-	val, empty := q.q.Pop()
-	for !empty {
-		q.processFn(val)
-		val, empty = q.q.Pop()
+// Len returns the number of values waiting to be processed.
+func (q *Queue) Len() int {
+	return q.q.Len()
+}
+
+// Running reports whether values are being processed.
+func (q *Queue) Running() bool {
+	return q.running.Get()
+}
+
+// schedule must only be called by the owner of the running flag.
+func (q *Queue) schedule() {
+	val, _ := q.q.Peek()
+	exec, _ := q.executorFor(val)
+	exec.Execute(func() { q.process(exec) })
+}
+
+// executorFor returns the executor val must be processed on and whether
+// val chose it.
+func (q *Queue) executorFor(val interface{}) (executor.Executor, bool) {
+	if r, ok := val.(Routed); ok {
+		if exec := r.Executor(); exec != nil {
+			return exec, true
+		}
+	}
+	return q.exec, false
+}
+
+func (q *Queue) process(exec executor.Executor) {
+	for {
+		for i := 0; i < batchSize; i++ {
+			val, empty := q.q.Peek()
+			if empty {
+				break
+			}
+			if want, routed := q.executorFor(val); routed && want != exec {
+				q.schedule()
+				return
+			}
+			q.q.Pop()
+			q.processFn(val)
+		}
+		if !q.q.Empty() {
+			q.schedule()
+			return
+		}
+		q.running.Set(false)
+		// A value pushed after the last Pop but before running was
+		// cleared would otherwise be stranded until the next Enqueue.
+		if q.q.Empty() || !q.running.CAS(false, true) {
+			return
+		}
 	}
-	q.running.Set(false)
 }
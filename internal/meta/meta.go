@@ -0,0 +1,38 @@
+// Package meta implements the metadata storage shared by the reference
+// types. The zero value holds nil metadata and is ready to use.
+package meta
+
+import "sync/atomic"
+
+type Meta struct {
+	data atomic.Pointer[interface{}]
+}
+
+func (m *Meta) Load() interface{} {
+	data := m.data.Load()
+	if data == nil {
+		return nil
+	}
+	return *data
+}
+
+func (m *Meta) Reset(new interface{}) interface{} {
+	m.data.Store(&new)
+	return new
+}
+
+func (m *Meta) Alter(fn func(...interface{}) interface{}, args []interface{}) interface{} {
+	fnargs := make([]interface{}, len(args)+1)
+	copy(fnargs[1:], args)
+	for {
+		old := m.data.Load()
+		fnargs[0] = nil
+		if old != nil {
+			fnargs[0] = *old
+		}
+		new := fn(fnargs...)
+		if m.data.CompareAndSwap(old, &new) {
+			return new
+		}
+	}
+}
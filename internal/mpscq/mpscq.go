@@ -15,8 +15,13 @@ type node struct {
 }
 
 type Queue struct {
-	head *node
-	tail *node
+	// pushed is only written by producers and popped only by the
+	// consumer so each sits with the pointer its writer updates.
+	head   *node
+	pushed uint64
+	_      [48]byte
+	tail   *node
+	popped uint64
 }
 
 func New() *Queue {
@@ -31,6 +36,9 @@ func (q *Queue) Push(val interface{}) {
 	n := &node{
 		val: val,
 	}
+	// Count before linking the node so that Len never sees it popped
+	// before it was pushed.
+	atomic.AddUint64(&q.pushed, 1)
 	prev := (*node)(atomic.SwapPointer(
 		(*unsafe.Pointer)(unsafe.Pointer(&q.head)),
 		unsafe.Pointer(n),
@@ -53,7 +61,35 @@ func (q *Queue) Pop() (interface{}, bool) {
 			(*unsafe.Pointer)(unsafe.Pointer(&q.tail)),
 			unsafe.Pointer(next),
 		)
+		atomic.StoreUint64(&q.popped, q.popped+1)
 		return out, false
 	}
 	return nil, true
 }
+
+func (q *Queue) Peek() (interface{}, bool) {
+	next := (*node)(atomic.LoadPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(&q.tail.next)),
+	))
+	if next != nil {
+		return next.val, false
+	}
+	return nil, true
+}
+
+func (q *Queue) Empty() bool {
+	tail := (*node)(atomic.LoadPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(&q.tail)),
+	))
+	return atomic.LoadPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(&tail.next)),
+	) == nil
+}
+
+// Len returns the number of values in the queue. It is only a snapshot
+// when there are concurrent producers and it may briefly count a value
+// that is still being pushed.
+func (q *Queue) Len() int {
+	popped := atomic.LoadUint64(&q.popped)
+	return int(atomic.LoadUint64(&q.pushed) - popped)
+}
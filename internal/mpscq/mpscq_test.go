@@ -24,6 +24,60 @@ func TestQueue(t *testing.T) {
 	}
 }
 
+func TestEmpty(t *testing.T) {
+	q := New()
+	if !q.Empty() {
+		t.Fatal("new queue isn't empty")
+	}
+	q.Push("foo")
+	if q.Empty() {
+		t.Fatal("queue with a value is empty")
+	}
+	q.Pop()
+	if !q.Empty() {
+		t.Fatal("drained queue isn't empty")
+	}
+}
+
+func TestLen(t *testing.T) {
+	q := New()
+	if q.Len() != 0 {
+		t.Fatal("new queue has length", q.Len())
+	}
+	for i := 0; i < 3; i++ {
+		q.Push(i)
+	}
+	q.Pop()
+	if q.Len() != 2 {
+		t.Fatal("expected length 2, got:", q.Len())
+	}
+	q.Pop()
+	q.Pop()
+	q.Pop()
+	if q.Len() != 0 {
+		t.Fatal("drained queue has length", q.Len())
+	}
+}
+
+func TestPeek(t *testing.T) {
+	q := New()
+	if _, empty := q.Peek(); !empty {
+		t.Fatal("peeked a value from an empty queue")
+	}
+	q.Push("foo")
+	q.Push("bar")
+	for i := 0; i < 2; i++ {
+		val, empty := q.Peek()
+		if val != "foo" || empty {
+			t.Fatal("didn't peek expected value foo, got:", val)
+		}
+	}
+	q.Pop()
+	if val, _ := q.Peek(); val != "bar" {
+		t.Fatal("didn't peek expected value bar, got:", val)
+	}
+}
+
 type atomicBool struct {
 	state int32
 }
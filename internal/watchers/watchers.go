@@ -1,53 +1,166 @@
 package watchers
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"jsouthworth.net/go/dyn"
+	"jsouthworth.net/go/etm"
+	"jsouthworth.net/go/etm/executor"
+	"jsouthworth.net/go/etm/internal/genfn"
 	"jsouthworth.net/go/etm/internal/jobq"
 	"jsouthworth.net/go/etm/internal/unsafe/ref"
 	"jsouthworth.net/go/immutable/hashmap"
 )
 
+// Overflow determines what happens to a change for a watcher whose
+// buffer is full.
+type Overflow int
+
+const (
+	// Block makes the notifier releasing the change wait for room in
+	// the buffer.
+	Block Overflow = iota + 1
+	// Drop drops the change.
+	Drop
+	// Coalesce merges the change with any others that didn't fit so
+	// the watcher sees a single change from the old value of the
+	// first to the new value of the last once there is room.
+	Coalesce
+)
+
+// Config determines how watchers are notified.
+type Config struct {
+	// Executor runs the watchers, the default executor is used if it
+	// is nil.
+	Executor executor.Executor
+	// Buffer is the number of changes that may be waiting for each
+	// watcher, 0 means there is no limit.
+	Buffer int
+	// Overflow applies when a watcher's buffer is full, the default
+	// is Block.
+	Overflow Overflow
+	// ErrorHandler is called with the errors returned by watchers
+	// and with their panics, which are otherwise ignored.
+	ErrorHandler func(key, ref interface{}, err error)
+	// MaxFailures is the number of consecutive failures after which
+	// a watcher is removed, 0 means watchers are never removed.
+	MaxFailures int
+}
+
+// Watchers is a set of watchers. Each watcher is notified through its
+// own queue so it sees changes in the order they were made without
+// waiting for the other watchers. Changes are ordered by the sequence
+// number they were given when they were committed.
 type Watchers struct {
 	watchers ref.Ref
-	queue    *jobq.Queue
+
+	// mu guards the changes waiting to be released to the watchers.
+	// next is the sequence number of the next change to release and
+	// early holds the changes notified before it. releasing reports
+	// whether a notifier is releasing changes.
+	mu        sync.Mutex
+	next      uint64
+	early     map[uint64]*change
+	releasing bool
 
 	equalityFn func(a, b interface{}) bool
+	config     Config
 }
 
 func New(equalityFunc func(a, b interface{}) bool) *Watchers {
+	return NewWithConfig(equalityFunc, Config{})
+}
+
+func NewWithConfig(equalityFunc func(a, b interface{}) bool, config Config) *Watchers {
+	if config.Executor == nil {
+		config.Executor = executor.Default
+	}
+	if config.Overflow == 0 {
+		config.Overflow = Block
+	}
 	return &Watchers{
 		watchers:   ref.Make(unsafe.Pointer(hashmap.Empty())),
-		queue:      jobq.New(notifyWatchers),
+		next:       1,
 		equalityFn: equalityFunc,
+		config:     config,
 	}
 }
 
-func (w *Watchers) Notify(ref, old, new interface{}) {
-	watchers := w.getWatchers()
-	if watchers.Length() == 0 {
+// Changed reports whether a change from old to new must be notified,
+// that is whether there are watchers and the values are not equal.
+// Changes that are not notified must not be given a sequence number.
+func (w *Watchers) Changed(old, new interface{}) bool {
+	return w.Len() > 0 && !w.equalityFn(old, new)
+}
+
+// Notify notifies the watchers of a change. seq is the sequence number
+// the change was given when it was committed, changes are numbered
+// from 1 and every number must be notified exactly once. Sync watchers
+// are called straight away, the others are passed the changes in seq
+// order: a change notified before the one preceding it is held until
+// that one is notified. The notifier that notifies the next change
+// releases it, and any held changes that follow, to the watchers.
+func (w *Watchers) Notify(seq uint64, ref, old, new interface{}) {
+	c := &change{ref: ref, old: old, new: new, seq: seq}
+	w.getWatchers().Range(func(key interface{}, watch *Watcher) {
+		if watch.Sync {
+			watch.call(c.forWatcher(key, watch))
+		}
+	})
+
+	w.mu.Lock()
+	if w.releasing || seq != w.next {
+		if w.early == nil {
+			w.early = make(map[uint64]*change)
+		}
+		w.early[seq] = c
+		w.mu.Unlock()
 		return
 	}
-	if w.equalityFn(old, new) {
-		return
+	w.releasing = true
+	for {
+		w.next++
+		w.mu.Unlock()
+		w.release(c)
+		w.mu.Lock()
+		next, ok := w.early[w.next]
+		if !ok {
+			break
+		}
+		delete(w.early, w.next)
+		c = next
 	}
-	w.queue.Enqueue(&watcherJob{
-		old:      old,
-		new:      new,
-		watchers: w,
-		ref:      ref,
+	w.releasing = false
+	w.mu.Unlock()
+}
+
+// release passes c to the watchers that aren't sync.
+func (w *Watchers) release(c *change) {
+	w.getWatchers().Range(func(key interface{}, watch *Watcher) {
+		if !watch.Sync {
+			watch.offer(c.forWatcher(key, watch))
+		}
 	})
 }
 
+func (w *Watchers) Len() int {
+	return w.getWatchers().Length()
+}
+
 func (w *Watchers) Add(key interface{}, watch *Watcher) {
+	watch.start(w)
 	for {
 		old := w.getWatchers()
 		new := old.Assoc(key, watch)
 		if w.watchers.CompareAndSwap(
 			unsafe.Pointer(old),
 			unsafe.Pointer(new)) {
+			if prev, ok := old.Find(key); ok {
+				prev.(*Watcher).stop()
+			}
 			return
 		}
 	}
@@ -60,6 +173,26 @@ func (w *Watchers) Delete(key interface{}) {
 		if w.watchers.CompareAndSwap(
 			unsafe.Pointer(old),
 			unsafe.Pointer(new)) {
+			if prev, ok := old.Find(key); ok {
+				prev.(*Watcher).stop()
+			}
+			return
+		}
+	}
+}
+
+// remove deletes the watcher with the key if it is still watch.
+func (w *Watchers) remove(key interface{}, watch *Watcher) {
+	for {
+		old := w.getWatchers()
+		if cur, ok := old.Find(key); !ok || cur != watch {
+			return
+		}
+		new := old.Delete(key)
+		if w.watchers.CompareAndSwap(
+			unsafe.Pointer(old),
+			unsafe.Pointer(new)) {
+			watch.stop()
 			return
 		}
 	}
@@ -72,6 +205,31 @@ func (w *Watchers) getWatchers() *hashmap.Map {
 type Watcher struct {
 	Fn   func(...interface{}) interface{}
 	Args []interface{}
+	// Ref, when set, is passed to the watcher in place of the
+	// reference given to Notify.
+	Ref interface{}
+	// Sync watchers are called by Notify on the notifying goroutine.
+	Sync bool
+	// OnChange, when set, is called instead of Fn with the sequence
+	// number of the change. Changes are numbered in the order they
+	// were committed.
+	OnChange func(seq uint64, old, new interface{}) error
+	// Buffer and Overflow override the watchers' configuration for
+	// this watcher when Buffer is not 0.
+	Buffer   int
+	Overflow Overflow
+
+	owner    *Watchers
+	failures int32
+
+	queue  *jobq.Queue
+	config Config
+
+	mu      sync.Mutex
+	room    sync.Cond
+	queued  int
+	merged  *change
+	stopped bool
 }
 
 func (w *Watcher) Apply(args ...interface{}) interface{} {
@@ -86,32 +244,165 @@ func (w *Watcher) Apply(args ...interface{}) interface{} {
 	return w.Fn(fnargs...)
 }
 
-type watcherJob struct {
+type change struct {
+	key, ref interface{}
 	old, new interface{}
-	watchers *Watchers
-	ref      interface{}
-}
-
-func notifyWatchers(val interface{}) {
-	job := val.(*watcherJob)
-	watchers := job.watchers.getWatchers()
-	switch watchers.Length() {
-	case 0:
-	case 1:
-		// If there is only one watcher don't incur
-		// the overhead of spinning up a goroutine
-		watchers.Range(func(key interface{}, w *Watcher) {
-			dyn.Apply(w, key, job.ref, job.old, job.new)
-		})
-	default:
-		var wg sync.WaitGroup
-		watchers.Range(func(key interface{}, w *Watcher) {
-			wg.Add(1)
-			go func() {
-				dyn.Apply(w, key, job.ref, job.old, job.new)
-				wg.Done()
-			}()
-		})
-		wg.Wait()
+	seq      uint64
+}
+
+// forWatcher returns a copy of c for the watcher with the key.
+func (c *change) forWatcher(key interface{}, watch *Watcher) *change {
+	wc := *c
+	wc.key = key
+	if watch.Ref != nil {
+		wc.ref = watch.Ref
+	}
+	return &wc
+}
+
+// Fn converts fn into the function of a Watcher. fn may return an error,
+// alone or after a value, which is returned by the resulting function.
+// Any other value returned by fn is ignored.
+func Fn(fn interface{}) func(...interface{}) interface{} {
+	f := genfn.MakeGenericE(fn)
+	return func(args ...interface{}) interface{} {
+		out, err := f(args...)
+		if err != nil {
+			return err
+		}
+		if err, ok := out.(error); ok {
+			return err
+		}
+		return nil
+	}
+}
+
+func (w *Watcher) start(watchers *Watchers) {
+	w.owner = watchers
+	w.config = watchers.config
+	if w.Buffer != 0 {
+		w.config.Buffer = w.Buffer
+		w.config.Overflow = w.Overflow
+		if w.config.Overflow == 0 {
+			w.config.Overflow = Block
+		}
+	}
+	if w.Sync {
+		return
+	}
+	w.room.L = &w.mu
+	w.queue = jobq.NewWithExecutor(w.deliver, w.config.Executor)
+}
+
+// stop is called once the watcher has been removed. Changes that are
+// still queued are not delivered and blocked notifiers are released.
+func (w *Watcher) stop() {
+	if w.Sync {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	w.merged = nil
+	w.mu.Unlock()
+	w.room.Broadcast()
+}
+
+func (w *Watcher) offer(c *change) {
+	if w.config.Buffer == 0 {
+		w.queue.Enqueue(c)
+		return
+	}
+	w.mu.Lock()
+	switch {
+	case w.stopped:
+	case w.merged != nil:
+		// Later changes must not overtake the merged one.
+		w.merged.new = c.new
+		w.merged.seq = c.seq
+	case w.queued < w.config.Buffer:
+		w.queued++
+		w.mu.Unlock()
+		w.queue.Enqueue(c)
+		return
+	case w.config.Overflow == Coalesce:
+		w.merged = c
+	case w.config.Overflow == Block:
+		for w.queued >= w.config.Buffer && !w.stopped {
+			w.room.Wait()
+		}
+		if !w.stopped {
+			w.queued++
+			w.mu.Unlock()
+			w.queue.Enqueue(c)
+			return
+		}
+	}
+	w.mu.Unlock()
+}
+
+func (w *Watcher) deliver(val interface{}) {
+	c := val.(*change)
+	w.mu.Lock()
+	stopped := w.stopped
+	w.mu.Unlock()
+	if !stopped {
+		w.call(c)
+	}
+	if w.config.Buffer == 0 {
+		return
+	}
+	w.mu.Lock()
+	w.queued--
+	if m := w.merged; m != nil {
+		w.merged = nil
+		if w.owner.equalityFn(m.old, m.new) {
+			// The changes merged into m undid each other.
+			w.mu.Unlock()
+			w.room.Signal()
+			return
+		}
+		w.queued++
+		w.mu.Unlock()
+		w.queue.Enqueue(m)
+		return
+	}
+	w.mu.Unlock()
+	w.room.Signal()
+}
+
+// call calls the watcher, reporting its failures.
+func (w *Watcher) call(c *change) {
+	key, ref := c.key, c.ref
+	err := w.apply(c)
+	if err == nil {
+		atomic.StoreInt32(&w.failures, 0)
+		return
+	}
+	if w.config.ErrorHandler != nil {
+		w.config.ErrorHandler(key, ref, err)
+	}
+	max := w.config.MaxFailures
+	if max > 0 && atomic.AddInt32(&w.failures, 1) >= int32(max) {
+		w.owner.remove(key, w)
+	}
+}
+
+func (w *Watcher) apply(c *change) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicError(c.key, v)
+		}
+	}()
+	if w.OnChange != nil {
+		return w.OnChange(c.seq, c.old, c.new)
+	}
+	err, _ = dyn.Apply(w, c.key, c.ref, c.old, c.new).(error)
+	return err
+}
+
+func panicError(key, v interface{}) error {
+	if err, ok := v.(error); ok {
+		return fmt.Errorf("%w: %v: %w", etm.ErrWatcherPanicked, key, err)
 	}
+	return fmt.Errorf("%w: %v: %v", etm.ErrWatcherPanicked, key, v)
 }
@@ -0,0 +1,140 @@
+// Package promise implements a single assignment reference. A promise
+// starts out empty and is delivered a value exactly once. Dereferencing
+// a promise blocks until it has been delivered, after which the value
+// never changes. Promises are useful for handing a result from one
+// goroutine to any number of others.
+package promise
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+// Promise is a reference that is delivered a value exactly once.
+type Promise struct {
+	done     chan struct{}
+	once     sync.Once
+	val      interface{}
+	watchers *watchers.Watchers
+}
+
+// New returns a new undelivered promise.
+func New() *Promise {
+	return &Promise{
+		done: make(chan struct{}),
+		// Delivery is always a change even when the value is nil.
+		watchers: watchers.New(func(a, b interface{}) bool {
+			return false
+		}),
+	}
+}
+
+// Deliver sets the value of the promise and releases all goroutines
+// blocked dereferencing it. Only the first delivery has any effect,
+// Deliver reports whether this call delivered the promise.
+func (p *Promise) Deliver(val interface{}) bool {
+	delivered := false
+	p.once.Do(func() {
+		p.val = val
+		close(p.done)
+		delivered = true
+	})
+	if delivered {
+		p.watchers.Notify(1, p, nil, val)
+	}
+	return delivered
+}
+
+// Deref blocks until the promise has been delivered and returns its
+// value.
+func (p *Promise) Deref() interface{} {
+	<-p.done
+	return p.val
+}
+
+// DerefTimeout is like Deref but returns fallback if the promise has
+// not been delivered within timeout.
+func (p *Promise) DerefTimeout(timeout time.Duration, fallback interface{}) interface{} {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return p.val
+	case <-timer.C:
+		return fallback
+	}
+}
+
+// DerefContext is like Deref but returns ctx.Err() if ctx is done before
+// the promise is delivered.
+func (p *Promise) DerefContext(ctx context.Context) (interface{}, error) {
+	select {
+	case <-p.done:
+		return p.val, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when the promise is delivered.
+func (p *Promise) Done() <-chan struct{} {
+	return p.done
+}
+
+// Realized reports whether the promise has been delivered.
+func (p *Promise) Realized() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Watch adds function to be called when the promise is delivered.
+//
+// Watchers must be functions of the following form:
+// func(key kT, promise *Promise, old oT, new nT)
+// Watchers may return a value or not but any returned value is ignored,
+// as is a panic in a watcher.
+// The key type must be the type of the key passed in when the watcher
+// is added, old is always nil and new is the delivered value. If the
+// promise can be delivered arbitrary types then the watcher should take
+// type interface{}.
+//
+// Watchers are called asynchronously once the promise is delivered.
+// Watchers added after delivery are never called.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (p *Promise) Watch(key interface{}, fn interface{}, args ...interface{}) *Promise {
+	f := watchers.Fn(fn)
+	watcher := &watchers.Watcher{
+		Fn:   f,
+		Args: args,
+	}
+	p.watchers.Add(key, watcher)
+	return p
+}
+
+// Ignore removes the watcher with the passed in key so that it will not
+// be called when the promise is delivered.
+func (p *Promise) Ignore(key interface{}) *Promise {
+	p.watchers.Delete(key)
+	return p
+}
+
+// AddWatch is like Watch but doesn't return the promise, see etm.Watchable.
+func (p *Promise) AddWatch(key interface{}, fn interface{}, args ...interface{}) {
+	p.Watch(key, fn, args...)
+}
+
+// RemoveWatch is like Ignore but doesn't return the promise, see
+// etm.Watchable.
+func (p *Promise) RemoveWatch(key interface{}) {
+	p.Ignore(key)
+}
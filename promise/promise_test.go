@@ -0,0 +1,88 @@
+package promise
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"jsouthworth.net/go/etm"
+)
+
+func TestDeliver(t *testing.T) {
+	p := New()
+	if p.Realized() {
+		t.Fatal("new promise is realized")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			if got := p.Deref(); got != 1 {
+				t.Errorf("got %v, wanted %v\n", got, 1)
+			}
+			wg.Done()
+		}()
+	}
+	if !p.Deliver(1) {
+		t.Fatal("first delivery failed")
+	}
+	if p.Deliver(2) {
+		t.Fatal("second delivery succeeded")
+	}
+	wg.Wait()
+	if got := p.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestDerefTimeout(t *testing.T) {
+	p := New()
+	if got := p.DerefTimeout(time.Millisecond, -1); got != -1 {
+		t.Fatalf("got %v, wanted %v\n", got, -1)
+	}
+	p.Deliver(1)
+	if got := p.DerefTimeout(time.Millisecond, -1); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestDerefContext(t *testing.T) {
+	p := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.DerefContext(ctx); err != context.Canceled {
+		t.Fatalf("got %v, wanted %v\n", err, context.Canceled)
+	}
+	p.Deliver(nil)
+	<-p.Done()
+	if got, err := p.DerefContext(context.Background()); got != nil || err != nil {
+		t.Fatalf("got %v, %v, wanted nil, nil\n", got, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	p := New()
+	delivered := make(chan interface{}, 2)
+	watcher := func(key string, p *Promise, old, new interface{}) {
+		delivered <- new
+	}
+	p.Watch("foo", watcher).Watch("bar", watcher).Watch("baz", watcher)
+	p.Ignore("baz")
+	p.Deliver(nil)
+	for i := 0; i < 2; i++ {
+		if got := <-delivered; got != nil {
+			t.Fatalf("got %v, wanted nil\n", got)
+		}
+	}
+	select {
+	case got := <-delivered:
+		t.Fatal("ignored watcher was called with", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+var (
+	_ etm.BlockingDeref = (*Promise)(nil)
+	_ etm.Watchable     = (*Promise)(nil)
+)
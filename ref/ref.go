@@ -0,0 +1,262 @@
+// Package ref implements a mechanism to manage shared state with
+// software transactional memory. A Ref is a coordinated identity,
+// changes to one or more refs are made inside of a transaction run by
+// Sync and either all of the changes become visible at once or none of
+// them do. Transactions see a consistent snapshot of every ref they read
+// using multiversion concurrency control and are retried automatically
+// when they conflict with another transaction. Reading the value of a
+// ref outside of a transaction does not require coordination with
+// updaters.
+package ref
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"jsouthworth.net/go/dyn"
+	"jsouthworth.net/go/etm"
+	"jsouthworth.net/go/etm/internal/genfn"
+	"jsouthworth.net/go/etm/internal/meta"
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+var lastID uint64
+
+// Ref is a mechanism to manage a piece of shared state that must be
+// updated in coordination with other refs.
+type Ref struct {
+	id uint64
+
+	mu      sync.RWMutex
+	history []tval // oldest first, the current value is last
+	faults  int32
+	// seq numbers the committed changes the watchers are notified of.
+	seq uint64
+
+	minHistory, maxHistory int
+
+	validator atomic.Pointer[func(interface{}) error]
+	watchers  *watchers.Watchers
+	meta      meta.Meta
+}
+
+type tval struct {
+	val   interface{}
+	point uint64
+}
+
+// New returns a new ref with an initial value of s. New panics if a
+// Validator is supplied that rejects s.
+func New(s interface{}, options ...Option) *Ref {
+	var opts refOptions
+
+	//Default to dyn's equal function
+	EqualityFunc(dyn.Equal)(&opts)
+	MaxHistory(10)(&opts)
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	r := &Ref{
+		id:         atomic.AddUint64(&lastID, 1),
+		history:    []tval{{val: s}},
+		minHistory: opts.minHistory,
+		maxHistory: opts.maxHistory,
+		watchers:   watchers.New(opts.equalityFn),
+	}
+	if opts.validator != nil {
+		if err := r.SetValidator(opts.validator); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Deref returns the most recently committed value of the ref. To read
+// the ref as part of a transaction use Tx.Deref.
+func (r *Ref) Deref() interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current().val
+}
+
+// SetValidator sets the function used to validate every new value of
+// the ref. New values are validated when the transaction that produced
+// them commits, a rejected value aborts the transaction and Sync
+// returns an error wrapping etm.ErrInvalidState. The current value is
+// validated first and if it is rejected the validator is not set and
+// the error is returned. Passing nil removes the validator.
+func (r *Ref) SetValidator(fn func(interface{}) error) error {
+	if fn == nil {
+		r.validator.Store(nil)
+		return nil
+	}
+	if err := fn(r.Deref()); err != nil {
+		return invalidState(err)
+	}
+	r.validator.Store(&fn)
+	return nil
+}
+
+// Meta returns the metadata of the ref.
+func (r *Ref) Meta() interface{} {
+	return r.meta.Load()
+}
+
+// ResetMeta replaces the metadata of the ref with m. Metadata is not
+// transactional.
+func (r *Ref) ResetMeta(m interface{}) interface{} {
+	return r.meta.Reset(m)
+}
+
+// AlterMeta updates the metadata of the ref to the result of applying
+// fn to the current metadata. AlterMeta takes a function of the form
+// func(old mT, args...) rT. Metadata is not transactional.
+func (r *Ref) AlterMeta(fn interface{}, args ...interface{}) interface{} {
+	return r.meta.Alter(genfn.MakeGeneric(fn), args)
+}
+
+// Watch adds function to be called when the value of the ref changes.
+//
+// Watchers must be functions of the following form:
+// func(key kT, ref *Ref, old oT, new nT)
+// Watchers may return a value or not but any returned value is ignored,
+// as is a panic in a watcher.
+// The key type must be the type of the key passed in when the watcher
+// is added, the Value types must be the type of the ref. If the ref
+// can take arbitrary types then the watcher should take type interface{}.
+//
+// Watchers are only called when the value actually changes and only
+// after the transaction that changed it has committed. A transaction
+// that is retried or aborted never notifies the watchers.
+//
+// All watchers are called asynchronously when the ref changes, this means
+// that one should not deref the ref in the watcher but should used the
+// passed in old and new values. Each watcher has its own queue of
+// changes so it sees the changes in the order they were committed, and
+// a slow watcher doesn't hold up the others.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (r *Ref) Watch(key interface{}, fn interface{}, args ...interface{}) *Ref {
+	f := watchers.Fn(fn)
+	watcher := &watchers.Watcher{
+		Fn:   f,
+		Args: args,
+	}
+	r.watchers.Add(key, watcher)
+	return r
+}
+
+// Ignore removes the watcher with the passed in key so that on the
+// next update it will not be in the watcher set. This takes effect
+// immediately so if a watcher removes its self, the next commit to the
+// ref will not contain the watcher.
+func (r *Ref) Ignore(key interface{}) *Ref {
+	r.watchers.Delete(key)
+	return r
+}
+
+// AddWatch is like Watch but doesn't return the ref, see etm.Watchable.
+func (r *Ref) AddWatch(key interface{}, fn interface{}, args ...interface{}) {
+	r.Watch(key, fn, args...)
+}
+
+// RemoveWatch is like Ignore but doesn't return the ref, see
+// etm.Watchable.
+func (r *Ref) RemoveWatch(key interface{}) {
+	r.Ignore(key)
+}
+
+// current must be called with r.mu held.
+func (r *Ref) current() tval {
+	return r.history[len(r.history)-1]
+}
+
+// at returns the newest value committed at or before point. It must be
+// called with r.mu held.
+func (r *Ref) at(point uint64) (interface{}, bool) {
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if r.history[i].point <= point {
+			return r.history[i].val, true
+		}
+	}
+	return nil, false
+}
+
+// push must be called with r.mu held for writing. The history grows
+// when readers have faulted looking for an old enough value, otherwise
+// the oldest value is discarded.
+func (r *Ref) push(val interface{}, point uint64) {
+	r.history = append(r.history, tval{val: val, point: point})
+	prior := len(r.history) - 1
+	if prior <= r.minHistory ||
+		(atomic.LoadInt32(&r.faults) > 0 && prior <= r.maxHistory) {
+		atomic.StoreInt32(&r.faults, 0)
+		return
+	}
+	copy(r.history, r.history[1:])
+	r.history[len(r.history)-1] = tval{}
+	r.history = r.history[:len(r.history)-1]
+}
+
+func (r *Ref) validate(val interface{}) error {
+	fn := r.validator.Load()
+	if fn == nil {
+		return nil
+	}
+	if err := (*fn)(val); err != nil {
+		return invalidState(err)
+	}
+	return nil
+}
+
+func invalidState(err error) error {
+	return fmt.Errorf("%w: %w", etm.ErrInvalidState, err)
+}
+
+func (r *Ref) fault() {
+	atomic.AddInt32(&r.faults, 1)
+}
+
+type Option func(*refOptions)
+
+type refOptions struct {
+	equalityFn             func(interface{}, interface{}) bool
+	validator              func(interface{}) error
+	minHistory, maxHistory int
+}
+
+func EqualityFunc(fn func(a, b interface{}) bool) Option {
+	return func(opts *refOptions) {
+		opts.equalityFn = fn
+	}
+}
+
+// Validator sets the function used to validate every new value of the
+// ref. See SetValidator.
+func Validator(fn func(interface{}) error) Option {
+	return func(opts *refOptions) {
+		opts.validator = fn
+	}
+}
+
+// MinHistory sets the number of prior values the ref always retains
+// for transactions reading an older snapshot. The default is 0.
+func MinHistory(n int) Option {
+	return func(opts *refOptions) {
+		opts.minHistory = n
+	}
+}
+
+// MaxHistory sets the maximum number of prior values the ref will
+// retain. The history only grows past MinHistory when a transaction
+// fails to find a value old enough for its snapshot. The default is 10.
+func MaxHistory(n int) Option {
+	return func(opts *refOptions) {
+		opts.maxHistory = n
+	}
+}
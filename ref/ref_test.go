@@ -0,0 +1,247 @@
+package ref
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"jsouthworth.net/go/etm"
+)
+
+func TestSyncAlter(t *testing.T) {
+	r := New(1)
+	err := Sync(func(tx *Tx) error {
+		tx.Alter(r, func(cur int) int {
+			return cur + 1
+		})
+		if got := tx.Deref(r); got != 2 {
+			t.Fatalf("got %v, wanted %v\n", got, 2)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Deref(); got != 2 {
+		t.Fatalf("got %v, wanted %v\n", got, 2)
+	}
+}
+
+func TestSyncAbort(t *testing.T) {
+	r := New(1)
+	errAbort := errors.New("abort")
+	err := Sync(func(tx *Tx) error {
+		tx.Set(r, 2)
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("got %v, wanted %v\n", err, errAbort)
+	}
+	if got := r.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	const n = 100
+	a := New(1000)
+	b := New(1000)
+	var wg sync.WaitGroup
+	wait := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-wait
+			from, to := a, b
+			if i%2 == 0 {
+				from, to = b, a
+			}
+			err := Sync(func(tx *Tx) error {
+				tx.Alter(from, func(cur, amt int) int {
+					return cur - amt
+				}, i)
+				tx.Alter(to, func(cur, amt int) int {
+					return cur + amt
+				}, i)
+				sum := tx.Deref(a).(int) + tx.Deref(b).(int)
+				if sum != 2000 {
+					t.Errorf("inconsistent snapshot, got %v, wanted 2000", sum)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	close(wait)
+	wg.Wait()
+
+	sum := a.Deref().(int) + b.Deref().(int)
+	if sum != 2000 {
+		t.Fatalf("got %v, wanted %v\n", sum, 2000)
+	}
+	// evens move i from b to a and odds move i from a to b
+	if a.Deref() != 950 {
+		t.Fatalf("got %v, wanted %v\n", a.Deref(), 950)
+	}
+}
+
+func TestCommute(t *testing.T) {
+	const n = 100
+	r := New(0)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Sync(func(tx *Tx) error {
+				tx.Commute(r, func(cur int) int {
+					return cur + 1
+				})
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if got := r.Deref(); got != n {
+		t.Fatalf("got %v, wanted %v\n", got, n)
+	}
+}
+
+func TestSetAfterCommute(t *testing.T) {
+	r := New(0)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected set after commute to panic")
+		}
+	}()
+	Sync(func(tx *Tx) error {
+		tx.Commute(r, func(cur int) int {
+			return cur + 1
+		})
+		tx.Set(r, 10)
+		return nil
+	})
+}
+
+func TestEnsure(t *testing.T) {
+	a := New(0)
+	b := New(0)
+	tries := 0
+	err := Sync(func(tx *Tx) error {
+		tries++
+		tx.Ensure(a)
+		if tries == 1 {
+			// Simulate a concurrent commit to the ensured ref.
+			done := make(chan struct{})
+			go func() {
+				Sync(func(tx *Tx) error {
+					tx.Set(a, 1)
+					return nil
+				})
+				close(done)
+			}()
+			<-done
+		}
+		tx.Set(b, tx.Deref(a))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tries != 2 {
+		t.Fatalf("got %v tries, wanted %v\n", tries, 2)
+	}
+	if got := b.Deref(); got != 1 {
+		t.Fatalf("got %v, wanted %v\n", got, 1)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	r := New(0, MinHistory(2), MaxHistory(2))
+	for i := 1; i <= 5; i++ {
+		Sync(func(tx *Tx) error {
+			tx.Set(r, i)
+			return nil
+		})
+	}
+	if len(r.history) != 3 {
+		t.Fatalf("got %v, wanted %v\n", len(r.history), 3)
+	}
+	if got := r.Deref(); got != 5 {
+		t.Fatalf("got %v, wanted %v\n", got, 5)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	a := New(0)
+	b := New(0)
+	var wg sync.WaitGroup
+	watcher := func(key string, r *Ref, old int, new int) {
+		if new != 10 {
+			t.Errorf("got %v, wanted %v\n", new, 10)
+		}
+		wg.Done()
+	}
+	wg.Add(2)
+	a.Watch("foo", watcher)
+	b.Watch("foo", watcher)
+	Sync(func(tx *Tx) error {
+		tx.Set(a, 10)
+		tx.Set(b, 10)
+		return nil
+	})
+	Sync(func(tx *Tx) error {
+		tx.Set(a, 20)
+		return errors.New("abort")
+	})
+	wg.Wait()
+	a.Ignore("foo")
+	b.Ignore("foo")
+}
+
+var (
+	_ etm.Deref       = (*Ref)(nil)
+	_ etm.Watchable   = (*Ref)(nil)
+	_ etm.Validatable = (*Ref)(nil)
+	_ etm.MetaHolder  = (*Ref)(nil)
+)
+
+func TestValidator(t *testing.T) {
+	a := New(1)
+	b := New(1, Validator(func(v interface{}) error {
+		if v.(int) < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}))
+	err := Sync(func(tx *Tx) error {
+		tx.Set(a, 2)
+		tx.Set(b, -1)
+		return nil
+	})
+	if !errors.Is(err, etm.ErrInvalidState) {
+		t.Fatalf("got %v, wanted %v\n", err, etm.ErrInvalidState)
+	}
+	if a.Deref() != 1 || b.Deref() != 1 {
+		t.Fatal("rejected transaction was partially committed")
+	}
+	if err := a.SetValidator(func(v interface{}) error {
+		return errors.New("never valid")
+	}); err == nil {
+		t.Fatal("validator rejecting the current value was set")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	r := New(0)
+	r.ResetMeta(1)
+	r.AlterMeta(func(cur int) int {
+		return cur * 10
+	})
+	if m := r.Meta(); m != 10 {
+		t.Fatalf("got %v, wanted %v\n", m, 10)
+	}
+}
@@ -0,0 +1,272 @@
+package ref
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"sync/atomic"
+
+	"jsouthworth.net/go/etm/internal/genfn"
+)
+
+// RetryLimit is the number of times Sync will attempt a transaction
+// before giving up with ErrRetryLimit.
+const RetryLimit = 10000
+
+// ErrRetryLimit is returned by Sync when a transaction could not be
+// committed within RetryLimit attempts.
+var ErrRetryLimit = errors.New("ref: transaction retry limit reached")
+
+// errConflict is returned by commit when another transaction committed
+// a conflicting change first.
+var errConflict = errors.New("ref: transaction conflict")
+
+// lastPoint is the commit point of the most recently committed
+// transaction. Every value of every ref is stamped with the point at
+// which it was committed.
+var lastPoint uint64
+
+type retry struct{}
+
+// Tx is a transaction. A Tx is only valid inside the function passed
+// to Sync and must not be shared between goroutines.
+type Tx struct {
+	readPoint uint64
+	vals      map[*Ref]interface{}
+	sets      map[*Ref]struct{}
+	ensures   map[*Ref]struct{}
+	commutes  map[*Ref][]commuteFn
+}
+
+type commuteFn struct {
+	fn   func(...interface{}) interface{}
+	args []interface{}
+}
+
+func (c commuteFn) apply(val interface{}) interface{} {
+	return c.fn(append([]interface{}{val}, c.args...)...)
+}
+
+type notification struct {
+	ref      *Ref
+	old, new interface{}
+	seq      uint64
+}
+
+// Sync runs fn in a transaction. All reads made through the transaction
+// see a consistent snapshot of the refs and all of the changes made
+// through it are committed atomically when fn returns nil. If fn returns
+// an error the transaction is aborted, none of its changes are
+// committed and the error is returned.
+//
+// When the transaction conflicts with another it is retried, which
+// means fn may be called more than once. fn should therefore be free of
+// side effects other than the changes it makes to refs.
+//
+// If a validator rejects a new value the transaction is aborted and Sync
+// returns an error wrapping etm.ErrInvalidState. Watchers of the changed
+// refs are notified only after the transaction has committed.
+func Sync(fn func(tx *Tx) error) error {
+	for i := 0; i < RetryLimit; i++ {
+		tx := newTx()
+		retried, err := tx.run(fn)
+		if retried {
+			runtime.Gosched()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		notes, err := tx.commit()
+		if err == errConflict {
+			runtime.Gosched()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, n := range notes {
+			n.ref.watchers.Notify(n.seq, n.ref, n.old, n.new)
+		}
+		return nil
+	}
+	return ErrRetryLimit
+}
+
+func newTx() *Tx {
+	return &Tx{
+		readPoint: atomic.LoadUint64(&lastPoint),
+		vals:      make(map[*Ref]interface{}),
+		sets:      make(map[*Ref]struct{}),
+		ensures:   make(map[*Ref]struct{}),
+		commutes:  make(map[*Ref][]commuteFn),
+	}
+}
+
+func (tx *Tx) run(fn func(tx *Tx) error) (retried bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(retry); !ok {
+				panic(r)
+			}
+			retried = true
+		}
+	}()
+	return false, fn(tx)
+}
+
+// Deref returns the value of the ref as seen by the transaction. This
+// is the value set in this transaction if there is one, otherwise it is
+// the value committed as of the start of the transaction.
+func (tx *Tx) Deref(r *Ref) interface{} {
+	if val, ok := tx.vals[r]; ok {
+		return val
+	}
+	r.mu.RLock()
+	val, ok := r.at(tx.readPoint)
+	r.mu.RUnlock()
+	if !ok {
+		r.fault()
+		panic(retry{})
+	}
+	return val
+}
+
+// Set sets the in-transaction value of the ref to val. Set panics if
+// the ref has been commuted in the transaction.
+func (tx *Tx) Set(r *Ref, val interface{}) interface{} {
+	_, set := tx.sets[r]
+	if _, commuted := tx.commutes[r]; commuted && !set {
+		panic("ref: can't set after commute")
+	}
+	if !set {
+		r.mu.RLock()
+		stale := r.current().point > tx.readPoint
+		r.mu.RUnlock()
+		if stale {
+			panic(retry{})
+		}
+		tx.sets[r] = struct{}{}
+	}
+	tx.vals[r] = val
+	return val
+}
+
+// Alter sets the in-transaction value of the ref to the result of
+// applying fn to its current in-transaction value. Alter takes a
+// function that is of the form func(old aT, args...) rT where aT is the
+// old type of the ref and rT is the desired type of the ref.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (tx *Tx) Alter(r *Ref, fn interface{}, args ...interface{}) interface{} {
+	f := genfn.MakeGeneric(fn)
+	return tx.Set(r, f(append([]interface{}{tx.Deref(r)}, args...)...))
+}
+
+// Commute sets the in-transaction value of the ref to the result of
+// applying fn to its current in-transaction value. At commit time fn is
+// applied again to the most recently committed value of the ref rather
+// than the one seen by the transaction, so commuting a ref never causes
+// the transaction to conflict. fn must therefore be commutative or the
+// caller must be happy with last-one-in-wins behavior.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (tx *Tx) Commute(r *Ref, fn interface{}, args ...interface{}) interface{} {
+	c := commuteFn{fn: genfn.MakeGeneric(fn), args: args}
+	val := c.apply(tx.Deref(r))
+	tx.vals[r] = val
+	tx.commutes[r] = append(tx.commutes[r], c)
+	return val
+}
+
+// Ensure protects the ref from modification by other transactions. The
+// transaction will only commit if the ref has not been changed since
+// the transaction started. This prevents write skew when a transaction
+// depends on a ref it does not change. Ensure returns the
+// in-transaction value of the ref.
+func (tx *Tx) Ensure(r *Ref) interface{} {
+	tx.ensures[r] = struct{}{}
+	return tx.Deref(r)
+}
+
+func (tx *Tx) commit() ([]notification, error) {
+	refs := tx.touched()
+	for _, r := range refs {
+		r.mu.Lock()
+	}
+	defer func() {
+		for _, r := range refs {
+			r.mu.Unlock()
+		}
+	}()
+
+	for _, r := range refs {
+		_, set := tx.sets[r]
+		_, ensured := tx.ensures[r]
+		if (set || ensured) && r.current().point > tx.readPoint {
+			return nil, errConflict
+		}
+	}
+
+	for r, fns := range tx.commutes {
+		if _, set := tx.sets[r]; set {
+			continue
+		}
+		val := r.current().val
+		for _, c := range fns {
+			val = c.apply(val)
+		}
+		tx.vals[r] = val
+	}
+
+	for r, val := range tx.vals {
+		if err := r.validate(val); err != nil {
+			return nil, err
+		}
+	}
+
+	point := atomic.AddUint64(&lastPoint, 1)
+	notes := make([]notification, 0, len(tx.vals))
+	for _, r := range refs {
+		new, ok := tx.vals[r]
+		if !ok {
+			continue
+		}
+		old := r.current().val
+		r.push(new, point)
+		if r.watchers.Changed(old, new) {
+			r.seq++
+			notes = append(notes, notification{ref: r, old: old, new: new, seq: r.seq})
+		}
+	}
+	return notes, nil
+}
+
+// touched returns every ref that must be locked to commit the
+// transaction, ordered by id so that concurrent commits always acquire
+// their locks in the same order.
+func (tx *Tx) touched() []*Ref {
+	seen := make(map[*Ref]struct{}, len(tx.vals)+len(tx.ensures))
+	refs := make([]*Ref, 0, len(tx.vals)+len(tx.ensures))
+	add := func(r *Ref) {
+		if _, ok := seen[r]; ok {
+			return
+		}
+		seen[r] = struct{}{}
+		refs = append(refs, r)
+	}
+	for r := range tx.vals {
+		add(r)
+	}
+	for r := range tx.ensures {
+		add(r)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].id < refs[j].id
+	})
+	return refs
+}
@@ -0,0 +1,197 @@
+// Package vars implements dynamic variables. A Var has a root value
+// shared by every goroutine and may be given a different value for the
+// extent of a context with Binding. Code that reads the var with Get
+// sees the innermost binding in its context or the root value if there
+// is none. This is the Go equivalent of Clojure's dynamic vars where the
+// context takes the place of the thread.
+package vars
+
+import (
+	"context"
+
+	"jsouthworth.net/go/etm/atom"
+	"jsouthworth.net/go/etm/internal/genfn"
+	"jsouthworth.net/go/etm/internal/meta"
+	"jsouthworth.net/go/etm/internal/watchers"
+)
+
+// Var is a dynamic variable.
+type Var struct {
+	root *atom.Atom
+	meta meta.Meta
+}
+
+type bindingKey struct {
+	v *Var
+}
+
+type binding struct {
+	val interface{}
+}
+
+// New returns a new var with a root value of root. New panics if a
+// Validator is supplied that rejects root.
+func New(root interface{}, options ...Option) *Var {
+	var opts varOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	var atomOptions []atom.Option
+	if opts.equalityFn != nil {
+		atomOptions = append(atomOptions,
+			atom.EqualityFunc(opts.equalityFn))
+	}
+	if opts.validator != nil {
+		atomOptions = append(atomOptions,
+			atom.Validator(opts.validator))
+	}
+
+	return &Var{
+		root: atom.New(root, atomOptions...),
+	}
+}
+
+// Binding returns a context in which v is bound to val. The binding
+// shadows the root value and any binding of v in ctx. Bindings are not
+// validated.
+func Binding(ctx context.Context, v *Var, val interface{}) context.Context {
+	return context.WithValue(ctx, bindingKey{v: v}, &binding{val: val})
+}
+
+// Get returns the value of the innermost binding of the var in ctx or
+// the root value if the var is not bound in ctx.
+func (v *Var) Get(ctx context.Context) interface{} {
+	if b, ok := ctx.Value(bindingKey{v: v}).(*binding); ok {
+		return b.val
+	}
+	return v.Deref()
+}
+
+// IsBound reports whether the var has a binding in ctx.
+func (v *Var) IsBound(ctx context.Context) bool {
+	_, ok := ctx.Value(bindingKey{v: v}).(*binding)
+	return ok
+}
+
+// Deref returns the root value of the var.
+func (v *Var) Deref() interface{} {
+	return v.root.Deref()
+}
+
+// AlterRoot updates the root value of the var synchronously. Bindings
+// are unaffected. AlterRoot takes a function that is of the form
+// func(old aT, args...) rT where aT is the old type of the root value
+// and rT is the desired type. AlterRoot panics with an error wrapping
+// etm.ErrInvalidState if the validator rejects the new root value, see
+// TryAlterRoot.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (v *Var) AlterRoot(fn interface{}, args ...interface{}) interface{} {
+	return v.root.Swap(fn, args...)
+}
+
+// TryAlterRoot is like AlterRoot but takes a function that may fail, of
+// the form func(old aT, args...) rT or func(old aT, args...) (rT, error).
+// If the function returns an error or the validator rejects the new
+// root value the root value is left unchanged and TryAlterRoot returns
+// the value the function was applied to along with the error.
+func (v *Var) TryAlterRoot(fn interface{}, args ...interface{}) (interface{}, error) {
+	return v.root.TrySwap(fn, args...)
+}
+
+// SetValidator sets the function used to validate every new root value
+// of the var. It follows the same rules as atom.Atom.SetValidator.
+func (v *Var) SetValidator(fn func(interface{}) error) error {
+	return v.root.SetValidator(fn)
+}
+
+// Meta returns the metadata of the var.
+func (v *Var) Meta() interface{} {
+	return v.meta.Load()
+}
+
+// ResetMeta replaces the metadata of the var with m.
+func (v *Var) ResetMeta(m interface{}) interface{} {
+	return v.meta.Reset(m)
+}
+
+// AlterMeta updates the metadata of the var to the result of applying
+// fn to the current metadata. AlterMeta takes a function of the form
+// func(old mT, args...) rT.
+func (v *Var) AlterMeta(fn interface{}, args ...interface{}) interface{} {
+	return v.meta.Alter(genfn.MakeGeneric(fn), args)
+}
+
+// Watch adds function to be called when the root value of the var
+// changes. Changes to bindings are not watched.
+//
+// Watchers must be functions of the following form:
+// func(key kT, v *Var, old oT, new nT)
+// Watchers may return a value or not but any returned value is ignored,
+// as is a panic in a watcher.
+// The key type must be the type of the key passed in when the watcher
+// is added, the Value types must be the type of the root value. If the
+// var can take arbitrary types then the watcher should take type
+// interface{}.
+//
+// Watchers follow the same rules as atom.Atom watchers.
+//
+// Passing a func(...interface{})interface{} avoids reflect based
+// function application allow faster execution at the expense of
+// some clarity.
+func (v *Var) Watch(key interface{}, fn interface{}, args ...interface{}) *Var {
+	f := watchers.Fn(fn)
+	v.root.Watch(key, &varWatcher{fn: f, v: v}, args...)
+	return v
+}
+
+// Ignore removes the watcher with the passed in key.
+func (v *Var) Ignore(key interface{}) *Var {
+	v.root.Ignore(key)
+	return v
+}
+
+// AddWatch is like Watch but doesn't return the var, see etm.Watchable.
+func (v *Var) AddWatch(key interface{}, fn interface{}, args ...interface{}) {
+	v.Watch(key, fn, args...)
+}
+
+// RemoveWatch is like Ignore but doesn't return the var, see
+// etm.Watchable.
+func (v *Var) RemoveWatch(key interface{}) {
+	v.Ignore(key)
+}
+
+type varWatcher struct {
+	fn func(...interface{}) interface{}
+	v  *Var
+}
+
+func (w *varWatcher) Apply(args ...interface{}) interface{} {
+	args[1] = w.v // replace the atom with this var
+	return w.fn(args...)
+}
+
+type Option func(*varOptions)
+
+type varOptions struct {
+	equalityFn func(interface{}, interface{}) bool
+	validator  func(interface{}) error
+}
+
+func EqualityFunc(fn func(a, b interface{}) bool) Option {
+	return func(opts *varOptions) {
+		opts.equalityFn = fn
+	}
+}
+
+// Validator sets the function used to validate every new root value of
+// the var. See SetValidator.
+func Validator(fn func(interface{}) error) Option {
+	return func(opts *varOptions) {
+		opts.validator = fn
+	}
+}
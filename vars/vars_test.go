@@ -0,0 +1,118 @@
+package vars
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"jsouthworth.net/go/etm"
+)
+
+func TestBinding(t *testing.T) {
+	v := New("root")
+	ctx := context.Background()
+	if got := v.Get(ctx); got != "root" {
+		t.Fatalf("got %v, wanted %v\n", got, "root")
+	}
+	outer := Binding(ctx, v, "outer")
+	inner := Binding(outer, v, "inner")
+	if got := v.Get(outer); got != "outer" {
+		t.Fatalf("got %v, wanted %v\n", got, "outer")
+	}
+	if got := v.Get(inner); got != "inner" {
+		t.Fatalf("got %v, wanted %v\n", got, "inner")
+	}
+	if v.IsBound(ctx) || !v.IsBound(inner) {
+		t.Fatal("IsBound doesn't reflect the bindings")
+	}
+
+	other := New("other")
+	if got := other.Get(inner); got != "other" {
+		t.Fatalf("got %v, wanted %v\n", got, "other")
+	}
+	nilBound := Binding(ctx, other, nil)
+	if got := other.Get(nilBound); got != nil {
+		t.Fatalf("got %v, wanted nil\n", got)
+	}
+}
+
+func TestAlterRoot(t *testing.T) {
+	v := New(1)
+	changes := make(chan int, 1)
+	v.Watch("foo", func(key string, w *Var, old, new int) {
+		if w != v {
+			t.Error("watcher got the wrong var")
+		}
+		changes <- new
+	})
+	bound := Binding(context.Background(), v, 10)
+	v.AlterRoot(func(cur, inc int) int {
+		return cur + inc
+	}, 2)
+	if got := v.Deref(); got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	if got := v.Get(bound); got != 10 {
+		t.Fatalf("got %v, wanted %v\n", got, 10)
+	}
+	if got := <-changes; got != 3 {
+		t.Fatalf("got %v, wanted %v\n", got, 3)
+	}
+	v.Ignore("foo")
+}
+
+var (
+	_ etm.Deref       = (*Var)(nil)
+	_ etm.Watchable   = (*Var)(nil)
+	_ etm.Validatable = (*Var)(nil)
+	_ etm.MetaHolder  = (*Var)(nil)
+)
+
+func TestValidator(t *testing.T) {
+	v := New(1, Validator(func(val interface{}) error {
+		if val.(int) < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}))
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, etm.ErrInvalidState) {
+			t.Fatalf("got %v, wanted %v\n", err, etm.ErrInvalidState)
+		}
+		if got := v.Deref(); got != 1 {
+			t.Fatalf("got %v, wanted %v\n", got, 1)
+		}
+	}()
+	v.AlterRoot(func(cur int) int {
+		return -cur
+	})
+}
+
+func TestTryAlterRoot(t *testing.T) {
+	v := New(1, Validator(func(val interface{}) error {
+		if val.(int) < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}))
+	got, err := v.TryAlterRoot(func(cur int) int {
+		return -cur
+	})
+	if !errors.Is(err, etm.ErrInvalidState) || got != 1 {
+		t.Fatalf("got %v, %v, wanted %v, %v\n", got, err, 1, etm.ErrInvalidState)
+	}
+	got, err = v.TryAlterRoot(func(cur, inc int) (int, error) {
+		return cur + inc, nil
+	}, 2)
+	if err != nil || got != 3 || v.Deref() != 3 {
+		t.Fatalf("got %v, %v, wanted %v, nil\n", got, err, 3)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	v := New(0)
+	v.ResetMeta("doc")
+	if m := v.Meta(); m != "doc" {
+		t.Fatalf("got %v, wanted %v\n", m, "doc")
+	}
+}